@@ -0,0 +1,171 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credential is one of the entries from the auth section of the config file.
+// Each entry has either a bearer token, or a user name and bcrypt password
+// hash for HTTP basic authentication.  The entry may only be used for the
+// listed verbs (i.e. control commands) on the listed repos, either of which
+// may contain "*" to allow everything.  Repos may also be glob patterns.
+type credential struct {
+	name     string
+	token    string
+	user     string
+	password []byte
+	repos    []string
+	verbs    []string
+}
+
+// credentials is the list of credentials accepted by the control API.  If it
+// is empty then authentication is disabled, and anyone can use the API.
+var credentials []*credential
+
+// dummyPassword is a bcrypt hash that basic auth passwords are checked against
+// when the user is unknown, so that the time taken doesn't reveal which users
+// exist.
+var dummyPassword []byte
+
+// globalVerbs are the verbs that don't apply to a repo.
+var globalVerbs = []string{"list", "create"}
+
+func loadAuth() error {
+	entries, err := cfg.GetMapList("auth")
+	if err != nil {
+		return err
+	}
+	credentials = nil
+	dummyPassword = nil
+	for i, entry := range entries {
+		c := &credential{
+			name:  entry["name"],
+			token: entry["token"],
+			user:  entry["user"],
+			repos: splitList(entry["repos"]),
+			verbs: splitList(entry["verbs"]),
+		}
+		if c.name == "" {
+			c.name = c.user
+		}
+		if c.name == "" {
+			return fmt.Errorf("auth entry %d: missing name", i+1)
+		}
+		if (c.token == "") == (c.user == "") {
+			return fmt.Errorf("auth entry '%s': need exactly one of token and user", c.name)
+		}
+		if c.user != "" {
+			c.password = []byte(entry["password"])
+			cost, err := bcrypt.Cost(c.password)
+			if err != nil {
+				return fmt.Errorf("auth entry '%s': password must be a bcrypt hash: %s", c.name, err)
+			}
+			if dummyPassword == nil {
+				dummyPassword, err = bcrypt.GenerateFromPassword([]byte(c.name), cost)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, pattern := range c.repos {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("auth entry '%s': invalid repo pattern '%s'", c.name, pattern)
+			}
+		}
+		credentials = append(credentials, c)
+	}
+	return nil
+}
+
+// authenticate returns the credential that matches the Authorization header of
+// the request, or nil if there isn't one.
+func authenticate(req *http.Request) *credential {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, c := range credentials {
+			if c.token != "" && subtle.ConstantTimeCompare([]byte(c.token), token) == 1 {
+				return c
+			}
+		}
+		return nil
+	}
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return nil
+	}
+	var found *credential
+	for _, c := range credentials {
+		if c.user != "" && subtle.ConstantTimeCompare([]byte(c.user), []byte(user)) == 1 && found == nil {
+			found = c
+		}
+	}
+	hash := dummyPassword
+	if found != nil {
+		hash = found.password
+	}
+	if hash == nil || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil
+	}
+	return found
+}
+
+// allowed returns true if the credential permits the verb to be used on the
+// given repo.  Verbs that don't apply to a repo (e.g. create) only need the
+// verb to be permitted, any other verb is refused if the repo is empty.
+func (c *credential) allowed(verb, repo string) bool {
+	if !contains(c.verbs, "*") && !contains(c.verbs, verb) {
+		return false
+	}
+	if contains(globalVerbs, verb) {
+		return true
+	}
+	if repo == "" {
+		return false
+	}
+	for _, pattern := range c.repos {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the request is allowed to use the verb on the repo,
+// returning the name of the identity making the request.  If the request is
+// not allowed then an error response has been sent, and ok is false.
+func authorize(verb, repo string, w http.ResponseWriter, req *http.Request) (name string, ok bool) {
+	if len(credentials) == 0 {
+		return "anonymous", true
+	}
+	c := authenticate(req)
+	if c == nil {
+		log.Printf("Unauthenticated %s request from %s\n", verb, req.RemoteAddr)
+		w.Header().Add("WWW-Authenticate", `Bearer realm="repo_server"`)
+		w.Header().Add("WWW-Authenticate", `Basic realm="repo_server"`)
+		http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if !c.allowed(verb, repo) {
+		if repo == "" {
+			log.Printf("'%s' not allowed to %s\n", c.name, verb)
+		} else {
+			log.Printf("'%s' not allowed to %s '%s'\n", c.name, verb, repo)
+		}
+		http.Error(w, "403: Forbidden", http.StatusForbidden)
+		return c.name, false
+	}
+	return c.name, true
+}
@@ -0,0 +1,276 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore is where the published files of the repos (i.e. their pool and
+// dists) are kept, and served from.  Keys are slash separated paths relative
+// to the repos directory, e.g. "myrepo/pool/main/f/foo/foo_1.0_all.deb" -
+// which is also the path that the file is served as under /r/.
+//
+// The repos are always built in the repos directory, and each file is then
+// given to the BlobStore once it is complete.
+type BlobStore interface {
+	// Put stores the contents of the local file at path as key.
+	Put(key, path string) error
+
+	// Delete removes key.  It is not an error if key doesn't exist.
+	Delete(key string) error
+
+	// List returns all the keys that start with prefix, which should end
+	// with a "/".
+	List(prefix string) ([]string, error)
+
+	// Handler returns a http.Handler that serves the stored files, using
+	// the request path as the key.
+	Handler() http.Handler
+}
+
+// blobStore is the BlobStore used for all repos.
+var blobStore BlobStore = localStore{}
+
+// openBlobStore sets blobStore from the storage setting in the config.
+func openBlobStore() error {
+	kind, err := cfg.Get("storage", "local")
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "local":
+		blobStore = localStore{}
+	case "s3":
+		blobStore, err = openS3Store()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown storage '%s'", kind)
+	}
+	return nil
+}
+
+// blobKey returns the key for the given path, relative to the repos
+// directory.
+func blobKey(elem ...string) string {
+	return filepath.ToSlash(filepath.Join(elem...))
+}
+
+// localStore serves the files straight from the repos directory, so there is
+// nothing to copy.
+type localStore struct{}
+
+func (localStore) Put(key, path string) error {
+	dest := filepath.Join(repoPath, filepath.FromSlash(key))
+	if path == dest {
+		return nil
+	}
+	srcInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	destInfo, err := os.Stat(dest)
+	if err == nil && os.SameFile(srcInfo, destInfo) {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	return copyFile(path, dest)
+}
+
+func (localStore) Delete(key string) error {
+	path := filepath.Join(repoPath, filepath.FromSlash(key))
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove '%s': %s\n", path, err)
+		return err
+	}
+	return nil
+}
+
+func (localStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	// The published dists are symlinks, so make sure that we walk the real
+	// directory.
+	dir, err := filepath.EvalSymlinks(filepath.Join(repoPath, filepath.FromSlash(prefix)))
+	if os.IsNotExist(err) {
+		return keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, prefix+filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to list '%s': %s\n", dir, err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (localStore) Handler() http.Handler {
+	return http.FileServer(http.Dir(repoPath))
+}
+
+// listBlobs returns the keys starting with prefix as a set.
+func listBlobs(prefix string) (map[string]bool, error) {
+	keys, err := blobStore.List(prefix)
+	if err != nil {
+		log.Printf("Failed to list blobs in '%s': %s\n", prefix, err)
+		return nil, err
+	}
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set, nil
+}
+
+// deleteBlobs removes all the blobs under the given prefix.
+func deleteBlobs(prefix string) error {
+	keys, err := blobStore.List(prefix)
+	if err != nil {
+		log.Printf("Failed to list blobs in '%s': %s\n", prefix, err)
+		return err
+	}
+	for _, key := range keys {
+		err = blobStore.Delete(key)
+		if err != nil {
+			log.Printf("Failed to delete blob '%s': %s\n", key, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadPool copies any of the repo's pool files that the blob store doesn't
+// have.  New pool files are copied as they are added, so this is only needed
+// for new snapshots, or files added before the store was configured.
+func (r *Repo) uploadPool() error {
+	existing, err := listBlobs(blobKey(r.Name, "pool") + "/")
+	if err != nil {
+		return err
+	}
+	for _, d := range r.Dists {
+		for _, rp := range d.Components {
+			for _, pg := range rp {
+				for _, set := range pg {
+					for _, pkg := range set {
+						for _, filename := range pkg.poolFiles() {
+							key := blobKey(r.Name, filename)
+							if existing[key] {
+								continue
+							}
+							err := blobStore.Put(key, filepath.Join(repoPath, r.Name, filename))
+							if err != nil {
+								log.Printf("Failed to store '%s': %s\n", key, err)
+								return err
+							}
+							existing[key] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// uploadDists copies the published dists of the repo to the blob store.
+func (r *Repo) uploadDists() error {
+	for _, codename := range r.Config.Codenames {
+		err := r.uploadDist(codename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadDist copies the published files of the given dist to the blob store,
+// and then removes any that are no longer published.  The Release files are
+// copied last, so that clients never see a Release file that lists index
+// files that haven't been copied yet.
+func (r *Repo) uploadDist(codename string) error {
+	prefix := blobKey(r.Name, "dists", codename) + "/"
+	existing, err := listBlobs(prefix)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.EvalSymlinks(r.distPath(codename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to find published dist '%s': %s\n", codename, err)
+		return err
+	}
+	published := make(map[string]bool)
+	var files, releases []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		published[prefix+rel] = true
+		switch {
+		case strings.Contains(rel, "by-hash/") && existing[prefix+rel]:
+			// by-hash files are named by their content, so never change.
+		case rel == "Release" || rel == "Release.gpg" || rel == "InRelease":
+			releases = append(releases, rel)
+		default:
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read published dist '%s': %s\n", codename, err)
+		return err
+	}
+	for _, rel := range append(files, releases...) {
+		err = blobStore.Put(prefix+rel, filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			log.Printf("Failed to store '%s': %s\n", prefix+rel, err)
+			return err
+		}
+	}
+	for key := range existing {
+		if published[key] {
+			continue
+		}
+		err = blobStore.Delete(key)
+		if err != nil {
+			log.Printf("Failed to delete blob '%s': %s\n", key, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore stores the metadata of all the repos in a single bbolt database.
+// Each repo has a top level bucket, holding its config, the file lists of its
+// debs (keyed by pool path) and a bucket for each dist.  The packages of a
+// dist are stored individually, keyed by component, arch, name and version
+// joined with NULs (component names may contain "/"), so that saving a repo
+// only writes the packages that have changed - and the packages can be looked
+// up without loading the whole repo.
+//
+// Only one process can have the database open at a time.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var (
+	configKey   = []byte("config")
+	distsKey    = []byte("dists")
+	filesKey    = []byte("files")
+	byHashKey   = []byte("by_hash")
+	upstreamKey = []byte("upstream")
+	packagesKey = []byte("packages")
+	contentsKey = []byte("contents")
+)
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		log.Printf("Failed to open metadata database '%s': %s\n", path, err)
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+// keySep separates the parts of a package key.  It can't appear in any of
+// them, as checkNames rejects it in component and arch names, and control
+// files can't contain it.
+const keySep = "\x00"
+
+func packageKey(component, arch, name, version string) []byte {
+	return []byte(strings.Join([]string{component, arch, name, version}, keySep))
+}
+
+func (bs *boltStore) Exists(name string) (bool, error) {
+	exists := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(name)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (bs *boltStore) Load(r *Repo) error {
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(r.Name))
+		if b == nil {
+			return &os.PathError{Op: "load", Path: r.Name, Err: os.ErrNotExist}
+		}
+		err := json.Unmarshal(b.Get(configKey), &r.Config)
+		if err != nil {
+			return err
+		}
+		r.Contents = make(map[string][]string)
+		if contents := b.Bucket(contentsKey); contents != nil {
+			err = contents.ForEach(func(k, v []byte) error {
+				var files []string
+				err := json.Unmarshal(v, &files)
+				if err != nil {
+					return err
+				}
+				r.Contents[string(k)] = files
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		r.Dists = make(map[string]*Dist)
+		dists := b.Bucket(distsKey)
+		if dists == nil {
+			return nil
+		}
+		return dists.ForEachBucket(func(codename []byte) error {
+			db := dists.Bucket(codename)
+			d := newDist()
+			r.Dists[string(codename)] = d
+			if v := db.Get(filesKey); v != nil {
+				err := json.Unmarshal(v, &d.Files)
+				if err != nil {
+					return err
+				}
+			}
+			if v := db.Get(byHashKey); v != nil {
+				err := json.Unmarshal(v, &d.ByHash)
+				if err != nil {
+					return err
+				}
+			}
+			d.Upstream = string(db.Get(upstreamKey))
+			pkgs := db.Bucket(packagesKey)
+			if pkgs == nil {
+				return nil
+			}
+			return pkgs.ForEach(func(k, v []byte) error {
+				bits := strings.Split(string(k), keySep)
+				if len(bits) != 4 {
+					return fmt.Errorf("invalid package key %q", k)
+				}
+				pkg := Package{}
+				err := json.Unmarshal(v, &pkg)
+				if err != nil {
+					return err
+				}
+				d.group(bits[0], bits[1]).add(bits[2], bits[3], pkg)
+				return nil
+			})
+		})
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to load metadata for '%s': %s\n", r.Name, err)
+	}
+	return err
+}
+
+func (bs *boltStore) Save(r *Repo) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(r.Name))
+		if err != nil {
+			return err
+		}
+		config, err := json.Marshal(r.Config)
+		if err != nil {
+			return err
+		}
+		err = b.Put(configKey, config)
+		if err != nil {
+			return err
+		}
+		contents, err := b.CreateBucketIfNotExists(contentsKey)
+		if err != nil {
+			return err
+		}
+		want := make(map[string][]byte, len(r.Contents))
+		for filename, files := range r.Contents {
+			v, err := json.Marshal(files)
+			if err != nil {
+				return err
+			}
+			want[filename] = v
+		}
+		err = syncBucket(contents, want)
+		if err != nil {
+			return err
+		}
+		dists, err := b.CreateBucketIfNotExists(distsKey)
+		if err != nil {
+			return err
+		}
+		// Remove any dists that the repo no longer has.
+		var old [][]byte
+		err = dists.ForEachBucket(func(codename []byte) error {
+			if _, ok := r.Dists[string(codename)]; !ok {
+				old = append(old, codename)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, codename := range old {
+			err = dists.DeleteBucket(codename)
+			if err != nil {
+				return err
+			}
+		}
+		for codename, d := range r.Dists {
+			err = saveDist(dists, codename, d)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save metadata for '%s': %s\n", r.Name, err)
+	}
+	return err
+}
+
+// saveDist writes the given dist into its bucket, only writing the packages
+// that have changed.
+func saveDist(dists *bolt.Bucket, codename string, d *Dist) error {
+	db, err := dists.CreateBucketIfNotExists([]byte(codename))
+	if err != nil {
+		return err
+	}
+	files, err := json.Marshal(d.Files)
+	if err != nil {
+		return err
+	}
+	err = db.Put(filesKey, files)
+	if err != nil {
+		return err
+	}
+	byHash, err := json.Marshal(d.ByHash)
+	if err != nil {
+		return err
+	}
+	err = db.Put(byHashKey, byHash)
+	if err != nil {
+		return err
+	}
+	err = db.Put(upstreamKey, []byte(d.Upstream))
+	if err != nil {
+		return err
+	}
+	pkgs, err := db.CreateBucketIfNotExists(packagesKey)
+	if err != nil {
+		return err
+	}
+	want := make(map[string][]byte)
+	for component, rp := range d.Components {
+		for arch, pg := range rp {
+			for name, set := range pg {
+				for version, pkg := range set {
+					v, err := json.Marshal(pkg)
+					if err != nil {
+						return err
+					}
+					want[string(packageKey(component, arch, name, version))] = v
+				}
+			}
+		}
+	}
+	return syncBucket(pkgs, want)
+}
+
+// syncBucket makes the contents of bucket b match want, only writing the keys
+// that have changed.
+func syncBucket(b *bolt.Bucket, want map[string][]byte) error {
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; {
+		if _, ok := want[string(k)]; ok {
+			k, _ = c.Next()
+			continue
+		}
+		err := c.Delete()
+		if err != nil {
+			return err
+		}
+		// Deleting moves the cursor on to the next key.
+		k, _ = c.Seek(k)
+	}
+	for k, v := range want {
+		if bytes.Equal(b.Get([]byte(k)), v) {
+			continue
+		}
+		err := b.Put([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *boltStore) Delete(name string) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		var names [][]byte
+		err := tx.ForEach(func(n []byte, _ *bolt.Bucket) error {
+			if string(n) == name || strings.HasPrefix(string(n), name+"/") {
+				names = append(names, n)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			err = tx.DeleteBucket(n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to delete metadata for '%s': %s\n", name, err)
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltSlashComponent(t *testing.T) {
+	dir := setupTestDirs(t)
+	bs, err := openBoltStore(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.db.Close()
+
+	r := newRepo("slash")
+	r.Config.Components = []string{"main", "main/debug"}
+	d := r.dist(r.Config.Codename)
+	d.group("main/debug", "amd64").add("hello-dbgsym", "1.0-1", Package{
+		Filename: "pool/main/debug/h/hello-dbgsym/hello-dbgsym_1.0-1_amd64.deb",
+	})
+	err = bs.Save(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Repo{Name: "slash"}
+	err = bs.Load(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, found := loaded.find(r.Config.Codename, "main/debug", "amd64", "hello-dbgsym", "1.0-1")
+	if !found {
+		t.Fatalf("package in main/debug not loaded: %+v", loaded.dist(r.Config.Codename).Components)
+	}
+	if pkg.Filename != "pool/main/debug/h/hello-dbgsym/hello-dbgsym_1.0-1_amd64.deb" {
+		t.Errorf("got Filename %q", pkg.Filename)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// byHashDigests maps the names used for the by-hash directories to functions
+// that return the matching digest from a RepoFile.
+var byHashDigests = map[string]func(f RepoFile) string{
+	"MD5Sum": func(f RepoFile) string { return f.Md5 },
+	"SHA1":   func(f RepoFile) string { return f.Sha1 },
+	"SHA256": func(f RepoFile) string { return f.Sha256 },
+}
+
+var defaultByHashHashes = []string{"SHA256"}
+
+const defaultByHashKeep = 3
+
+// checkByHashHashes validates a list of by-hash hash names for use in a
+// RepoConfig.
+func checkByHashHashes(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no by-hash hashes given")
+	}
+	for _, name := range names {
+		if _, found := byHashDigests[name]; !found {
+			return fmt.Errorf("unknown by-hash hash: '%s'", name)
+		}
+	}
+	return nil
+}
+
+// storeByHash copies the index file at path (rel is the path relative to the
+// dist directory) into the by-hash directories next to it, and then removes
+// any by-hash files from generations older than the configured number to
+// keep.
+func (r *Repo) storeByHash(codename, rel, path string, file RepoFile) error {
+	d := r.dist(codename)
+	dir := filepath.Join(filepath.Dir(path), "by-hash")
+	for _, name := range r.Config.ByHashHashes {
+		dest := filepath.Join(dir, name, byHashDigests[name](file))
+		err := copyFile(path, dest)
+		if err != nil {
+			log.Printf("Failed to store '%s' by hash: %s\n", rel, err)
+			return err
+		}
+	}
+
+	// Update the history for this file, most recent first.
+	hist := []RepoFile{file}
+	for _, old := range d.ByHash[rel] {
+		if old.Sha256 != file.Sha256 {
+			hist = append(hist, old)
+		}
+	}
+	keep := r.Config.ByHashKeep + 1
+	if len(hist) <= keep {
+		d.ByHash[rel] = hist
+		return nil
+	}
+	d.ByHash[rel] = hist[:keep]
+	for _, old := range hist[keep:] {
+		for name, digest := range byHashDigests {
+			if r.byHashInUse(codename, filepath.Dir(rel), name, digest(old)) {
+				continue
+			}
+			err := os.Remove(filepath.Join(dir, name, digest(old)))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove old by-hash file: %s\n", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// byHashInUse returns true if the given digest is still retained for any file
+// in the given directory (relative to the dist directory).
+func (r *Repo) byHashInUse(codename, dir, name, digest string) bool {
+	for rel, hist := range r.dist(codename).ByHash {
+		if filepath.Dir(rel) != dir {
+			continue
+		}
+		for _, file := range hist {
+			if byHashDigests[name](file) == digest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeByHash removes all the by-hash directories in the given dist, which
+// is needed when by-hash support is turned off.
+func (r *Repo) removeByHash(codename string) error {
+	d := r.dist(codename)
+	base := r.distPath(codename)
+	for rel := range d.ByHash {
+		dir := filepath.Join(base, filepath.Dir(rel), "by-hash")
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Printf("Failed to remove '%s': %s\n", dir, err)
+			return err
+		}
+	}
+	d.ByHash = make(map[string][]RepoFile)
+	return nil
+}
+
+// copyFile copies the file at src to dest, creating the parent directory of
+// dest if required.  The copy is written to a temporary file which is then
+// renamed, so dest is never left partially written (e.g. if the disk fills).
+func copyFile(src, dest string) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/kylelemons/go-gypsy/yaml"
 )
@@ -81,6 +82,27 @@ func (c *Config) GetUint64(name string, def uint64) (uint64, error) {
 	return c.getUint(name, def, 64)
 }
 
+// scalarOrList returns the value of a yaml.Scalar node, or the values of a
+// yaml.List of scalars joined with spaces.
+func scalarOrList(node yaml.Node) (string, error) {
+	switch n := node.(type) {
+	case yaml.Scalar:
+		return string(n), nil
+	case yaml.List:
+		vals := make([]string, len(n))
+		for i, n2 := range n {
+			s, ok := n2.(yaml.Scalar)
+			if !ok {
+				return "", fmt.Errorf("Expected yaml.Scalar, got %T\n", n2)
+			}
+			vals[i] = string(s)
+		}
+		return strings.Join(vals, " "), nil
+	default:
+		return "", fmt.Errorf("Expected yaml.Scalar, got %T\n", node)
+	}
+}
+
 func (c *Config) GetMapList(name string) ([]map[string]string, error) {
 	node, err := yaml.Child(c.file.Root, name)
 	if _, ok := err.(*yaml.NodeNotFound); ok {
@@ -88,11 +110,15 @@ func (c *Config) GetMapList(name string) ([]map[string]string, error) {
 	} else if err != nil {
 		return nil, err
 	}
-	l, ok := node.(yaml.List)
-	if l == nil {
-		// Looks like we don't get NodeNotFound from Child?
+	if node == nil {
+		// An empty setting is returned as a nil node, rather than as
+		// NodeNotFound.
+		return nil, nil
+	}
+	if s, ok := node.(yaml.Scalar); ok && strings.TrimSpace(string(s)) == "[]" {
 		return nil, nil
 	}
+	l, ok := node.(yaml.List)
 	if !ok {
 		return nil, fmt.Errorf("Expected yaml.List, got %T\n", node)
 	}
@@ -104,11 +130,11 @@ func (c *Config) GetMapList(name string) ([]map[string]string, error) {
 			return nil, fmt.Errorf("Expected yaml.Map, got %T\n", node)
 		}
 		for name, n2 := range m {
-			s, ok := n2.(yaml.Scalar)
-			if !ok {
-				return nil, fmt.Errorf("Expected yaml.Scalar, got %T\n", node)
+			s, err := scalarOrList(n2)
+			if err != nil {
+				return nil, err
 			}
-			ret[i][name] = string(s)
+			ret[i][name] = s
 		}
 	}
 	return ret, nil
@@ -0,0 +1,123 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"repo_server/deb"
+)
+
+// contentsIndex maps file paths to the locations (i.e. section/package) of
+// the packages that contain them.
+type contentsIndex map[string][]string
+
+func (ci contentsIndex) add(pkg *Package, files []string) {
+	section := pkg.Control["Section"]
+	if section == "" {
+		section = "unknown"
+	}
+	location := section + "/" + pkg.Control["Package"]
+	for _, file := range files {
+		if !contains(ci[file], location) {
+			ci[file] = append(ci[file], location)
+		}
+	}
+}
+
+// writeContents writes the Contents-<arch>.gz files for each component of the
+// given dist, along with the combined files for the whole dist.
+func (r *Repo) writeContents(codename string) error {
+	d := r.dist(codename)
+	base := r.distPath(codename)
+	for _, arch := range r.Config.Architectures {
+		all := make(contentsIndex)
+		for _, component := range r.Config.Components {
+			ci := make(contentsIndex)
+			for _, set := range d.group(component, arch) {
+				for _, pkg := range set {
+					files, found := r.Contents[pkg.Filename]
+					if !found {
+						files = r.loadContents(pkg.Filename)
+					}
+					ci.add(&pkg, files)
+					all.add(&pkg, files)
+				}
+			}
+			filename := filepath.Join(base, component, "Contents-"+arch)
+			err := r.writeContentsFile(codename, filename, ci)
+			if err != nil {
+				return err
+			}
+		}
+		filename := filepath.Join(base, "Contents-"+arch)
+		err := r.writeContentsFile(codename, filename, all)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadContents returns the file list of a deb that was added before file
+// lists were recorded, by reading it from the pool.  If the deb can't be read
+// then it is left out of the Contents indices, rather than stopping the repo
+// from being published.
+func (r *Repo) loadContents(filename string) []string {
+	path := filepath.Join(repoPath, r.Name, filename)
+	// deb.Open creates the file if it is missing, so check first.
+	_, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Failed to find '%s' in pool, not listing its contents: %s\n", filename, err)
+		return nil
+	}
+	d, err := deb.Open(path)
+	if err != nil {
+		log.Printf("Failed to open deb '%s', not listing its contents: %s\n", path, err)
+		return nil
+	}
+	defer d.Close()
+	files, err := d.Files()
+	if err != nil {
+		log.Printf("Failed to list files in deb '%s', not listing its contents: %s\n", path, err)
+		return nil
+	}
+	r.Contents[filename] = files
+	return files
+}
+
+func (r *Repo) writeContentsFile(codename, filename string, ci contentsIndex) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		log.Printf("Failed to create directory '%s': %s\n", filepath.Dir(filename), err)
+		return err
+	}
+	files := make([]string, 0, len(ci))
+	for file := range ci {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	w, err := r.newIndexWriter(codename, filename, []string{"gz"})
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		locations := ci[file]
+		sort.Strings(locations)
+		line := fmt.Sprintf("%-55s %s\n", file, strings.Join(locations, ","))
+		_, err := w.Write([]byte(line))
+		if err != nil {
+			log.Printf("Failed to write '%s': %s\n", filename, err)
+			w.abort()
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -12,8 +12,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"repo_server/deb"
 	"repo_server/opgp"
 )
 
@@ -35,7 +38,22 @@ func handleControlRequest(w http.ResponseWriter, req *http.Request) {
 	}
 	bits := strings.Split(strings.Trim(req.URL.Path[3:], "/"), "/")
 	command := strings.ToLower(bits[0])
-	log.Printf("Command: %s\n", command)
+	repo := ""
+	if len(bits) > 1 {
+		repo = bits[1]
+	}
+	user, ok := authorize(command, repo, w, req)
+	if !ok {
+		return
+	}
+	if (command == "copy" || command == "move") && len(bits) > 2 {
+		// These also change the destination repo.
+		_, ok = authorize(command, bits[2], w, req)
+		if !ok {
+			return
+		}
+	}
+	log.Printf("Command: %s (by %s)\n", command, user)
 	switch command {
 	case "list":
 		if argCountOk(0, bits, w, req) {
@@ -65,6 +83,34 @@ func handleControlRequest(w http.ResponseWriter, req *http.Request) {
 		if argCountOk(1, bits, w, req) {
 			listPackages(bits[1], w, req)
 		}
+	case "prune":
+		if argCountOk(1, bits, w, req) {
+			prune(bits[1], w, req)
+		}
+	case "import":
+		if argCountOk(1, bits, w, req) {
+			importDebs(bits[1], w, req)
+		}
+	case "copy", "move":
+		if argCountOk(2, bits, w, req) {
+			copyPackages(bits[1], bits[2], command == "move", w, req)
+		}
+	case "mirror":
+		if argCountOk(1, bits, w, req) {
+			mirror(bits[1], w, req)
+		}
+	case "snapshot":
+		if argCountOk(2, bits, w, req) {
+			snapshot(bits[1], bits[2], w, req)
+		}
+	case "snapshots":
+		if argCountOk(1, bits, w, req) {
+			listSnapshots(bits[1], w, req)
+		}
+	case "delete-snapshot":
+		if argCountOk(2, bits, w, req) {
+			deleteSnapshot(bits[1], bits[2], w, req)
+		}
 	default:
 		http.NotFound(w, req)
 	}
@@ -105,12 +151,56 @@ type CreateResp struct {
 
 func createRepo(w http.ResponseWriter, req *http.Request) {
 	repo := NewRepo()
+	// The lists default to the single values, if they aren't given.
+	repo.Config.Codenames = nil
+	repo.Config.Components = nil
 	err := json.NewDecoder(req.Body).Decode(&repo.Config)
 	if err != nil {
 		log.Printf("Failed to decode JSON create request: %s\n", err)
 		http.Error(w, "400: Create JSON Invalid", http.StatusBadRequest)
 		return
 	}
+	if len(repo.Config.Architectures) == 0 {
+		repo.Config.Architectures = defaultArches
+	}
+	if len(repo.Config.Compressions) == 0 {
+		repo.Config.Compressions = defaultCompressions
+	}
+	err = checkArches(repo.Config.Architectures)
+	if err == nil {
+		err = checkCompressions(repo.Config.Compressions)
+	}
+	if err == nil && repo.Config.ByHashKeep < 0 {
+		err = fmt.Errorf("by_hash_keep may not be negative")
+	}
+	if err == nil && len(repo.Config.ByHashHashes) == 0 {
+		repo.Config.ByHashHashes = defaultByHashHashes
+	}
+	if err == nil {
+		err = checkByHashHashes(repo.Config.ByHashHashes)
+	}
+	if err == nil {
+		err = repo.Config.checkComponentConfig()
+	}
+	if err == nil {
+		err = repo.Config.checkDistConfig()
+	}
+	if err == nil {
+		err = repo.Config.checkReleaseConfig()
+	}
+	if err == nil {
+		err = repo.Config.checkRetentionConfig()
+	}
+	if err == nil && repo.Config.Mirror != nil {
+		// The mirror settings give access to the network and files on the
+		// server, so can only be used by repos in the config file.
+		err = fmt.Errorf("mirror can't be set for temporary repos")
+	}
+	if err != nil {
+		log.Printf("Invalid create request: %s\n", err)
+		http.Error(w, "400: Create JSON Invalid", http.StatusBadRequest)
+		return
+	}
 	if repo.Config.Sign {
 		repo.Config.GpgKey, err = getDefaultKey()
 		if err != nil {
@@ -136,32 +226,161 @@ func deleteRepo(name string, w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "403: Forbidden", http.StatusForbidden)
 		return
 	}
+	unlock, err := lockRepo(name)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
 	path := filepath.Join(repoPath, name)
-	err := os.RemoveAll(path)
+	err = os.RemoveAll(path)
 	if err != nil {
 		log.Printf("Failed to delete repo '%s': %s\n", name, err)
 		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	err = metaStore.Delete(name)
+	if err == nil {
+		err = deleteBlobs(blobKey(name) + "/")
+	}
+	if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = sweepStore()
+	if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// lockRepoRequest takes the lock for the named repo while handling a request.
+// If the lock can't be taken then an error response is sent, and nil is
+// returned.
+func lockRepoRequest(name string, w http.ResponseWriter, req *http.Request) func() {
+	unlock, err := lockRepo(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, req)
+		return nil
+	} else if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+	return unlock
+}
+
+// targetDist returns the dist and component that packages should be added to,
+// from the dist and component query parameters or the repo defaults.  If they
+// aren't valid then an error response has been sent, and ok is false.
+func targetDist(repo *Repo, w http.ResponseWriter, req *http.Request) (codename, component string, ok bool) {
+	codename = req.URL.Query().Get("dist")
+	if codename == "" {
+		codename = repo.Config.Codename
+	}
+	if !repo.hasDist(codename) {
+		log.Printf("Attempt to include into unknown dist: %s\n", codename)
+		http.Error(w, "400: Unknown Dist", http.StatusBadRequest)
+		return "", "", false
+	}
+	component = req.URL.Query().Get("component")
+	if component == "" {
+		component = repo.Config.Component
+	}
+	if !repo.hasComponent(component) {
+		log.Printf("Attempt to include into unknown component: %s\n", component)
+		http.Error(w, "400: Unknown Component", http.StatusBadRequest)
+		return "", "", false
+	}
+	return codename, component, true
+}
+
 func include(name, debName string, w http.ResponseWriter, req *http.Request) {
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
 	repo, err := LoadRepo(name)
 	if err != nil {
 		http.NotFound(w, req)
 		return
 	}
-	dir, debPath, err := saveUpload(name, debName, req.Body)
+	codename, component, ok := targetDist(repo, w, req)
+	if !ok {
+		return
+	}
+	if maxUploadSize > 0 {
+		if req.ContentLength > maxUploadSize {
+			log.Printf("Upload of %d bytes is too large\n", req.ContentLength)
+			http.Error(w, "413: Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, maxUploadSize)
+	}
+	if strings.HasSuffix(debName, ".dsc") {
+		includeSource(repo, debName, codename, component, w, req)
+		return
+	}
+	dir, debPath, hw, err := saveUpload(name, debName, req.Body)
 	if dir != "" {
 		defer os.RemoveAll(dir)
 	}
-	if err != nil {
+	if tooLarge(err) {
+		http.Error(w, "413: Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	err = repo.Add(debPath)
+	err = repo.Add(debPath, hw, codename, component)
+	if _, ok := err.(*deb.InvalidVersion); ok {
+		http.Error(w, "400: Invalid Package Version", http.StatusBadRequest)
+		return
+	} else if _, ok := err.(*PoolConflict); ok {
+		http.Error(w, "409: Conflict", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// includeSource handles the upload of a source package, which is sent as a
+// multipart/form-data request containing the .dsc and all the files it lists.
+func includeSource(repo *Repo, dscName, codename, component string, w http.ResponseWriter, req *http.Request) {
+	dir, err := saveMultipartUpload(repo.Name, req)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if tooLarge(err) {
+		http.Error(w, "413: Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "400: Bad Request", http.StatusBadRequest)
+		return
+	}
+	dscPath := filepath.Join(dir, filepath.Base(dscName))
+	_, err = os.Stat(dscPath)
 	if err != nil {
+		log.Printf("Source upload didn't include '%s'\n", dscName)
+		http.Error(w, "400: Bad Request", http.StatusBadRequest)
+		return
+	}
+	err = repo.AddSource(dscPath, codename, component)
+	switch err.(type) {
+	case nil:
+	case *deb.InvalidDsc, *deb.InvalidVersion:
+		http.Error(w, "400: Invalid Source Package", http.StatusBadRequest)
+		return
+	case *PoolConflict:
+		http.Error(w, "409: Conflict", http.StatusConflict)
+		return
+	default:
 		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -169,12 +388,19 @@ func include(name, debName string, w http.ResponseWriter, req *http.Request) {
 }
 
 type RemoveReq struct {
-	Name    string   `json:"name"`
-	Version string   `json:"version"`
-	Arches  []string `json:"arches"`
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	Arches     []string `json:"arches"`
+	Components []string `json:"components"`
+	Dists      []string `json:"dists"`
 }
 
 func remove(name string, w http.ResponseWriter, req *http.Request) {
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
 	repo, err := LoadRepo(name)
 	if err != nil {
 		http.NotFound(w, req)
@@ -193,16 +419,203 @@ func remove(name string, w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if len(rem.Arches) == 0 {
-		rem.Arches = []string{"i386", "amd64", "source"}
+		rem.Arches = repo.groupNames()
+	}
+	if len(rem.Components) == 0 {
+		rem.Components = repo.Config.Components
+	}
+	if len(rem.Dists) == 0 {
+		rem.Dists = repo.Config.Codenames
+	}
+	for _, codename := range rem.Dists {
+		for _, component := range rem.Components {
+			for _, arch := range rem.Arches {
+				err := repo.Remove(codename, component, rem.Name, rem.Version, arch)
+				if err != nil {
+					http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+	err = repo.Save()
+	if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type ImportResp struct {
+	Results []ImportResult `json:"results"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// importDebs adds all the .debs in the tar stream in the request body to the
+// repo, returning the result for each one.  The max-upload-size limit applies
+// to each .deb, rather than the whole stream.
+func importDebs(name string, w http.ResponseWriter, req *http.Request) {
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	repo, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	codename, component, ok := targetDist(repo, w, req)
+	if !ok {
+		return
+	}
+	results, err := repo.ImportTar(req.Body, maxUploadSize, codename, component)
+	resp := ImportResp{Results: results}
+	if err != nil && results == nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		// Some of the debs may have been imported before the error, so
+		// the client still needs the results.
+		resp.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("Failed to encode JSON import response: %s\n", err)
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
 	}
-	for _, arch := range rem.Arches {
-		err := repo.Remove(rem.Name, rem.Version, arch)
+}
+
+// CopyReq selects the package to be copied (or moved) between repos.  Dist
+// and Component default to the default codename and component of the source
+// repo, DestDist and DestComponent to those of the destination repo, and
+// Arches to all the arches (including source).
+type CopyReq struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	Arches        []string `json:"arches"`
+	Dist          string   `json:"dist"`
+	Component     string   `json:"component"`
+	DestDist      string   `json:"dest_dist"`
+	DestComponent string   `json:"dest_component"`
+}
+
+func copyPackages(name, destName string, move bool, w http.ResponseWriter, req *http.Request) {
+	if name == destName {
+		log.Printf("Attempt to copy from '%s' to itself\n", name)
+		http.Error(w, "400: Bad Request", http.StatusBadRequest)
+		return
+	}
+	// Always take the locks in the same order, so that two requests going in
+	// opposite directions can't deadlock.
+	first, second := name, destName
+	if second < first {
+		first, second = second, first
+	}
+	unlock := lockRepoRequest(first, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	unlock = lockRepoRequest(second, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	src, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	dest, err := LoadRepo(destName)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	creq := CopyReq{
+		Dist:          src.Config.Codename,
+		Component:     src.Config.Component,
+		DestDist:      dest.Config.Codename,
+		DestComponent: dest.Config.Component,
+	}
+	err = json.NewDecoder(req.Body).Decode(&creq)
+	if err != nil {
+		log.Printf("Failed to decode JSON copy request: %s\n", err)
+		http.Error(w, "400: Copy JSON Invalid", http.StatusBadRequest)
+		return
+	}
+	if creq.Name == "" || creq.Version == "" {
+		log.Printf("Invalid copy request: %+v", creq)
+		http.Error(w, "400: Copy JSON incomplete", http.StatusBadRequest)
+		return
+	}
+	if !dest.hasDist(creq.DestDist) || !dest.hasComponent(creq.DestComponent) {
+		http.Error(w, "400: Unknown Destination", http.StatusBadRequest)
+		return
+	}
+	if len(creq.Arches) == 0 {
+		creq.Arches = src.groupNames()
+	}
+	found := []string{}
+	copied := make(map[string]bool)
+	added := make(map[string]string)
+	for _, arch := range creq.Arches {
+		pkg, ok := src.find(creq.Dist, creq.Component, arch, creq.Name, creq.Version)
+		if !ok {
+			continue
+		}
+		if arch != "source" && pkg.Control["Architecture"] != "all" && !dest.hasArch(arch) {
+			log.Printf("Can't copy %s:%s to '%s', which doesn't have arch %s\n", creq.Name, creq.Version, destName, arch)
+			http.Error(w, "400: Unsupported Architecture", http.StatusBadRequest)
+			return
+		}
+		found = append(found, arch)
+		// "Architecture: all" packages are in every arch, but only need
+		// copying once.
+		if copied[pkg.Filename] {
+			continue
+		}
+		copied[pkg.Filename] = true
+		files, err := dest.CopyFrom(src, creq.Name, creq.Version, pkg, creq.DestDist, creq.DestComponent)
+		for filename, sum := range files {
+			added[filename] = sum
+		}
+		if err != nil {
+			// The destination isn't saved, so nothing will refer to the
+			// files that have already been copied.
+			dest.removePoolFiles(added)
+			if _, ok := err.(*PoolConflict); ok {
+				http.Error(w, "409: Conflict", http.StatusConflict)
+			} else {
+				http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	if len(found) == 0 {
+		http.Error(w, "404: Package Not Found", http.StatusNotFound)
+		return
+	}
+	_, removed := dest.prune(pkgVersion{creq.Name, creq.Version})
+	err = dest.saveAndRemove(removed)
+	if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !move {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	for _, arch := range found {
+		err = src.Remove(creq.Dist, creq.Component, creq.Name, creq.Version, arch)
 		if err != nil {
 			http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 	}
-	err = repo.Save()
+	err = src.Save()
 	if err != nil {
 		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
 		return
@@ -210,6 +623,161 @@ func remove(name string, w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+type PruneResp struct {
+	DryRun   bool            `json:"dry_run"`
+	Packages []PrunedPackage `json:"packages"`
+}
+
+// prune applies the retention policy of the repo, returning the list of
+// package versions that were removed.  If the dry-run query parameter is true
+// then nothing is removed, and the response lists what would have been.
+func prune(name string, w http.ResponseWriter, req *http.Request) {
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	repo, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	resp := PruneResp{}
+	if val := req.URL.Query().Get("dry-run"); val != "" {
+		resp.DryRun, err = strconv.ParseBool(val)
+		if err != nil {
+			http.Error(w, "400: Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+	if resp.DryRun {
+		resp.Packages = repo.expired(time.Now())
+	} else {
+		resp.Packages, err = repo.Prune()
+		if err != nil {
+			http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if resp.Packages == nil {
+		resp.Packages = []PrunedPackage{}
+	}
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("Failed to encode JSON prune response: %s\n", err)
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func snapshot(name, snapName string, w http.ResponseWriter, req *http.Request) {
+	if !validSnapshotName(snapName) {
+		log.Printf("Invalid snapshot name: %s\n", snapName)
+		http.Error(w, "400: Invalid Snapshot Name", http.StatusBadRequest)
+		return
+	}
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	repo, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	err = repo.Snapshot(snapName)
+	if os.IsExist(err) {
+		http.Error(w, "409: Snapshot Already Exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type SnapshotsResp struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+func listSnapshots(name string, w http.ResponseWriter, req *http.Request) {
+	repo, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	snapshots, err := repo.Snapshots()
+	if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(SnapshotsResp{snapshots})
+	if err != nil {
+		log.Printf("Failed to encode JSON snapshots response: %s\n", err)
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func deleteSnapshot(name, snapName string, w http.ResponseWriter, req *http.Request) {
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	repo, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	err = repo.DeleteSnapshot(snapName)
+	if os.IsNotExist(err) {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type MirrorResp struct {
+	Changed  bool              `json:"changed"`
+	Packages []MirroredPackage `json:"packages"`
+}
+
+// mirror updates a mirror repo from upstream, returning the list of package
+// versions that were fetched.
+func mirror(name string, w http.ResponseWriter, req *http.Request) {
+	unlock := lockRepoRequest(name, w, req)
+	if unlock == nil {
+		return
+	}
+	defer unlock()
+	repo, err := LoadRepo(name)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if repo.Config.Mirror == nil {
+		http.Error(w, "400: Not A Mirror", http.StatusBadRequest)
+		return
+	}
+	resp := MirrorResp{}
+	resp.Packages, resp.Changed, err = repo.Mirror()
+	if _, ok := err.(*opgp.BadSignature); ok {
+		http.Error(w, "502: Bad Upstream Signature", http.StatusBadGateway)
+		return
+	} else if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("Failed to encode JSON mirror response: %s\n", err)
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
 type KeyResp struct {
 	Id       string `json:"id"`
 	Filename string `json:"filename"`
@@ -239,8 +807,28 @@ func genKey(name string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// ListPkgsResp lists the packages in a repo.  Packages combines the packages
+// from all the components and dists, Components combines all the dists but
+// gives the packages per component, while Dists gives the full breakdown.
 type ListPkgsResp struct {
-	Packages PackageDetails `json:"packages"`
+	Packages   PackageDetails   `json:"packages"`
+	Components ComponentDetails `json:"components"`
+	Dists      DistDetails      `json:"dists"`
+}
+
+func (pd PackageDetails) merge(other PackageDetails) {
+	for pkg, versions := range other {
+		if pd[pkg] == nil {
+			pd[pkg] = make(map[string][]string)
+		}
+		for version, arches := range versions {
+			for _, arch := range arches {
+				if !contains(pd[pkg][version], arch) {
+					pd[pkg][version] = append(pd[pkg][version], arch)
+				}
+			}
+		}
+	}
 }
 
 func listPackages(name string, w http.ResponseWriter, req *http.Request) {
@@ -249,8 +837,35 @@ func listPackages(name string, w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
-	packages := r.ListPackages()
-	err = json.NewEncoder(w).Encode(ListPkgsResp{packages})
+	dists := r.ListPackages()
+	if codename := req.URL.Query().Get("dist"); codename != "" {
+		if !r.hasDist(codename) {
+			http.NotFound(w, req)
+			return
+		}
+		dists = DistDetails{codename: dists[codename]}
+	}
+	if component := req.URL.Query().Get("component"); component != "" {
+		if !r.hasComponent(component) {
+			http.NotFound(w, req)
+			return
+		}
+		for codename, components := range dists {
+			dists[codename] = ComponentDetails{component: components[component]}
+		}
+	}
+	packages := make(PackageDetails)
+	components := make(ComponentDetails)
+	for _, details := range dists {
+		for component, pd := range details {
+			if components[component] == nil {
+				components[component] = make(PackageDetails)
+			}
+			components[component].merge(pd)
+			packages.merge(pd)
+		}
+	}
+	err = json.NewEncoder(w).Encode(ListPkgsResp{packages, components, dists})
 	if err != nil {
 		log.Printf("Failed to encode JSON key response: %s\n", err)
 		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
@@ -0,0 +1,130 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"repo_server/deb"
+)
+
+// find returns the given version of a package from the repo.
+func (r *Repo) find(codename, component, arch, name, version string) (Package, bool) {
+	if !r.hasDist(codename) || !r.hasComponent(component) {
+		return Package{}, false
+	}
+	pkg, found := r.dist(codename).Components[component][arch][name][version]
+	return pkg, found
+}
+
+// CopyFrom adds a package from the src repo to the given dist and component,
+// along with its pool files.  The pool files are hard linked where possible,
+// but if the repo signs debs then a copy signed with its key (replacing any
+// existing signature) is made instead.  A pool file that the repo already
+// uses is kept, as long as it has the same contents - otherwise a
+// *PoolConflict is returned.  The repo is not saved.  The pool files that
+// were added are returned (with their SHA256s), even if the copy fails, so
+// that they can be removed with removePoolFiles if the repo isn't going to be
+// saved.
+func (r *Repo) CopyFrom(src *Repo, name, version string, pkg Package, codename, component string) (map[string]string, error) {
+	added := make(map[string]string)
+	arch := "source"
+	if pkg.Directory == "" {
+		arch = pkg.Control["Architecture"]
+	}
+	groups, err := r.getArch(codename, component, arch)
+	if err != nil {
+		return added, err
+	}
+	dir, err := ioutil.TempDir(tmpPath, r.Name+"-")
+	if err != nil {
+		log.Printf("Failed to create tmp directory: %s\n", err)
+		return added, err
+	}
+	defer os.RemoveAll(dir)
+	sign := pkg.Directory == "" && r.Config.SignDebs
+	for _, filename := range pkg.poolFiles() {
+		srcPath := filepath.Join(repoPath, src.Name, filename)
+		if existing, found := r.usedBy(filename); found {
+			same, err := r.samePoolFile(srcPath, filename, existing)
+			if err != nil {
+				return added, err
+			}
+			if !same {
+				log.Printf("'%s' already exists with different contents\n", filename)
+				return added, &PoolConflict{filename}
+			}
+			if pkg.Directory == "" {
+				pkg.Size = existing.Size
+				pkg.Sha1 = existing.Sha1
+				pkg.Sha256 = existing.Sha256
+				pkg.Md5 = existing.Md5
+			}
+			continue
+		}
+		tmp := filepath.Join(dir, filepath.Base(filename))
+		if sign {
+			// Signing modifies the file, so it mustn't be a link to the
+			// original.
+			err = copyFile(srcPath, tmp)
+			if err == nil {
+				err = unsignDeb(tmp)
+			}
+			if err == nil {
+				err = r.signDeb(tmp)
+			}
+		} else {
+			err = linkPoolFile(srcPath, tmp)
+		}
+		if err != nil {
+			log.Printf("Failed to copy '%s' from '%s': %s\n", filename, src.Name, err)
+			return added, err
+		}
+		hw, err := r.moveToPool(tmp, filename, nil)
+		if err != nil {
+			return added, err
+		}
+		added[filename] = hw.Sha256()
+		if sign {
+			pkg.Size = uint64(hw.Written())
+			pkg.Sha1 = hw.Sha1()
+			pkg.Sha256 = hw.Sha256()
+			pkg.Md5 = hw.Md5()
+		}
+	}
+	if files, found := src.Contents[pkg.Filename]; found && pkg.Directory == "" {
+		r.Contents[pkg.Filename] = files
+	}
+	pkg.Added = time.Now().UTC()
+	for _, pkgs := range groups {
+		pkgs.add(name, version, pkg)
+	}
+	return added, nil
+}
+
+// samePoolFile returns true if the file at path has the same contents as the
+// pool file filename of pkg.  If the repo signs debs then deb signatures are
+// ignored, as in sameDeb.
+func (r *Repo) samePoolFile(path, filename string, pkg Package) (bool, error) {
+	if pkg.Directory != "" {
+		hw, err := hashFile(path)
+		if err != nil {
+			log.Printf("Failed to read '%s': %s\n", path, err)
+			return false, err
+		}
+		return hw.Sha256() == pkg.poolHashes()[filename], nil
+	}
+	d, err := deb.Open(path)
+	if err != nil {
+		log.Printf("Failed to open deb '%s': %s\n", path, err)
+		return false, err
+	}
+	defer d.Close()
+	return r.sameDeb(d, path, nil, pkg)
+}
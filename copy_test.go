@@ -0,0 +1,157 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"repo_server/deb"
+	"repo_server/opgp"
+)
+
+// testKeyring creates a keyring holding a new signing key for each of the
+// given names, and returns the IDs of the keys.
+func testKeyring(t *testing.T, dir string, names ...string) []string {
+	path := filepath.Join(dir, "keyring")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	for _, name := range names {
+		e, err := openpgp.NewEntity(name, "", "", &packet.Config{RSABits: 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.SerializePrivate(f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, fmt.Sprintf("%08X", e.PrimaryKey.KeyId&0xFFFFFFFF))
+	}
+	old := opgp.KeyringFile
+	opgp.KeyringFile = path
+	t.Cleanup(func() { opgp.KeyringFile = old })
+	return ids
+}
+
+func newTestRepo(t *testing.T, name string, setup func(r *Repo)) {
+	r := newRepo(name)
+	r.Config.Architectures = []string{"amd64"}
+	if setup != nil {
+		setup(r)
+	}
+	err := r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contentHash(t *testing.T, path string) string {
+	d, err := deb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	h, err := d.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestCopyBetweenSigningRepos(t *testing.T) {
+	dir := setupTestDirs(t)
+	keys := testKeyring(t, dir, "Unstable Signer", "Stable Signer")
+	for i, name := range []string{"unstable", "stable"} {
+		key := keys[i]
+		newTestRepo(t, name, func(r *Repo) {
+			r.Config.SignDebs = true
+			r.Config.GpgKey = key
+		})
+	}
+	code := controlRequest(t, "POST", "/c/include/unstable/hello.deb", "@deb/testdata/gz.deb")
+	if code != http.StatusOK {
+		t.Fatalf("include: got %d", code)
+	}
+
+	// The second copy finds the package already there, and keeps it.
+	for i := 0; i < 2; i++ {
+		code = controlRequest(t, "POST", "/c/copy/unstable/stable", `{"name": "hello", "version": "1.0-1"}`)
+		if code != http.StatusOK {
+			t.Fatalf("copy %d: got %d", i+1, code)
+		}
+	}
+
+	r, err := LoadRepo("stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, found := r.find(r.Config.Codename, "main", "amd64", "hello", "1.0-1")
+	if !found {
+		t.Fatalf("hello not copied")
+	}
+	path := filepath.Join(repoPath, "stable", pkg.Filename)
+	hw, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hw.Sha256() != pkg.Sha256 {
+		t.Errorf("pool file has SHA256 %s, but the index has %s", hw.Sha256(), pkg.Sha256)
+	}
+	if contentHash(t, path) != contentHash(t, "deb/testdata/gz.deb") {
+		t.Errorf("copied deb has different contents")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("Signer: Stable Signer")) || bytes.Contains(data, []byte("Signer: Unstable Signer")) {
+		t.Errorf("copied deb isn't signed by just the destination's key")
+	}
+}
+
+func TestCopyConflict(t *testing.T) {
+	setupTestDirs(t)
+	newTestRepo(t, "src", nil)
+	newTestRepo(t, "dest", nil)
+	// signed.deb is a different file with the same name as gz.deb.
+	code := controlRequest(t, "POST", "/c/include/src/hello.deb", "@deb/testdata/signed.deb")
+	if code != http.StatusOK {
+		t.Fatalf("include into src: got %d", code)
+	}
+	code = controlRequest(t, "POST", "/c/include/dest/hello.deb", "@deb/testdata/gz.deb")
+	if code != http.StatusOK {
+		t.Fatalf("include into dest: got %d", code)
+	}
+
+	code = controlRequest(t, "POST", "/c/copy/src/dest", `{"name": "hello", "version": "1.0-1"}`)
+	if code != http.StatusConflict {
+		t.Errorf("copy of a different deb: got %d, want %d", code, http.StatusConflict)
+	}
+
+	r, err := LoadRepo("dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := r.find(r.Config.Codename, "main", "amd64", "hello", "1.0-1")
+	hw, err := hashFile(filepath.Join(repoPath, "dest", pkg.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hw.Sha256() != pkg.Sha256 {
+		t.Errorf("pool file in use was replaced")
+	}
+}
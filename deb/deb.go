@@ -7,20 +7,26 @@ package deb
 import (
 	"archive/tar"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 	"time"
 
 	"repo_server/opgp"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/qur/ar"
 	"github.com/qur/godebiancontrol"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
 type Deb struct {
@@ -34,7 +40,7 @@ type NotFound struct {
 }
 
 func (nf *NotFound) Error() string {
-	return fmt.Sprintf("Section '%s' was not found in deb '%s'", nf.name, nf.d)
+	return fmt.Sprintf("Section '%s' was not found in deb '%s'", nf.name, nf.d.name)
 }
 
 type InvalidDeb struct {
@@ -95,39 +101,102 @@ func (d *Deb) validate() error {
 }
 
 func (d *Deb) findSection(name string) (io.Reader, error) {
+	_, rd, err := d.findTarSection(name, []string{""})
+	return rd, err
+}
+
+// findTarSection finds the first section whose name is name followed by one of
+// the given extensions, returning the name of the section found.
+func (d *Deb) findTarSection(name string, exts []string) (string, io.Reader, error) {
 	_, err := d.f.Seek(0, 0)
 	if err != nil {
-		return nil, &InvalidDeb{d, err}
+		return "", nil, &InvalidDeb{d, err}
 	}
 	rd := ar.NewReader(d.f)
-	section := ""
-	for section != name {
+	for {
 		hdr, err := rd.Next()
 		if err == io.EOF {
-			return nil, &NotFound{d, name}
+			return "", nil, &NotFound{d, name}
 		} else if err != nil {
-			return nil, &InvalidDeb{d, err}
+			return "", nil, &InvalidDeb{d, err}
+		}
+		section := strings.Trim(hdr.Name, "/")
+		if !strings.HasPrefix(section, name) {
+			continue
+		}
+		for _, ext := range exts {
+			if section == name+ext {
+				return section, rd, nil
+			}
+		}
+	}
+}
+
+// openTar finds the (possibly compressed) tar section with the given base name
+// (e.g. "control.tar"), and returns a tar.Reader for its contents.  The
+// returned Closer must be closed when the reader is finished with.
+func (d *Deb) openTar(name string, exts []string) (*tar.Reader, io.Closer, error) {
+	section, rd, err := d.findTarSection(name, exts)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := Decompress(strings.TrimPrefix(section, name), rd)
+	if err != nil {
+		return nil, nil, &InvalidDeb{d, err}
+	}
+	return tar.NewReader(r), r, nil
+}
+
+// Decompress returns a reader that decompresses r according to the file
+// extension ext.
+func Decompress(ext string, r io.Reader) (io.ReadCloser, error) {
+	switch ext {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".xz":
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(x), nil
+	case ".zst":
+		z, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return z.IOReadCloser(), nil
+	case ".bz2":
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case ".lzma":
+		l, err := lzma.NewReader(r)
+		if err != nil {
+			return nil, err
 		}
-		section = strings.Trim(hdr.Name, "/")
+		return ioutil.NopCloser(l), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %s", ext)
 	}
-	return rd, nil
 }
 
 func (d *Deb) Close() error {
 	return d.f.Close()
 }
 
+// These are the compression formats that dpkg-deb supports for the control
+// and data sections of a .deb.
+var (
+	controlExts = []string{".gz", ".xz", ".zst", ""}
+	dataExts    = []string{".gz", ".xz", ".zst", ".bz2", ".lzma", ""}
+)
+
 func (d *Deb) Control(name string) ([]map[string]string, error) {
-	f, err := d.findSection("control.tar.gz")
+	t, c, err := d.openTar("control.tar", controlExts)
 	if err != nil {
 		return nil, err
 	}
-	g, err := gzip.NewReader(f)
-	if err != nil {
-		return nil, &InvalidDeb{d, err}
-	}
-	defer g.Close()
-	t := tar.NewReader(g)
+	defer c.Close()
 	filename := ""
 	for filename != name {
 		hdr, err := t.Next()
@@ -153,6 +222,51 @@ func (d *Deb) Control(name string) ([]map[string]string, error) {
 	return info, nil
 }
 
+// WalkData calls fn for each entry in the data section of the deb, passing a
+// reader for the contents of the entry.  If fn returns an error, then the walk
+// is stopped and that error is returned.
+func (d *Deb) WalkData(fn func(hdr *tar.Header, r io.Reader) error) error {
+	t, c, err := d.openTar("data.tar", dataExts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &InvalidDeb{d, err}
+		}
+		err = fn(hdr, t)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Files returns the paths of all the files (i.e. everything except
+// directories) in the data section of the deb.  The paths are relative to the
+// root directory, without a leading "./" or "/".
+func (d *Deb) Files() ([]string, error) {
+	files := []string{}
+	err := d.WalkData(func(hdr *tar.Header, r io.Reader) error {
+		if hdr.FileInfo().IsDir() {
+			return nil
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		name = strings.TrimLeft(name, "/")
+		if name != "" {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
 func (d *Deb) hashSections() (string, error) {
 	h1 := sha1.New()
 	h5 := md5.New()
@@ -188,6 +302,70 @@ func (d *Deb) hashSections() (string, error) {
 	}
 }
 
+// ContentHash returns the SHA256 of the members of the deb, ignoring any
+// signature added by Sign - so it is the same before and after signing.
+func (d *Deb) ContentHash() (string, error) {
+	_, err := d.f.Seek(0, 0)
+	if err != nil {
+		return "", &InvalidDeb{d, err}
+	}
+	h := sha256.New()
+	rd := ar.NewReader(d.f)
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		} else if err != nil {
+			return "", &InvalidDeb{d, err}
+		}
+		w := io.Writer(h)
+		if hdr.Name == "_gpgbuilder" {
+			w = ioutil.Discard
+		} else {
+			fmt.Fprintf(h, "%s %d\n", hdr.Name, hdr.Size)
+		}
+		_, err = io.Copy(w, rd)
+		if err != nil {
+			return "", &InvalidDeb{d, err}
+		}
+	}
+}
+
+// Unsign removes the signature added by Sign, if there is one, so that the
+// deb can be signed again (e.g. with a different key).  The signature must be
+// the last member of the deb, as it is when added by Sign.
+func (d *Deb) Unsign() error {
+	_, err := d.f.Seek(0, 0)
+	if err != nil {
+		return &InvalidDeb{d, err}
+	}
+	// Members start after the 8 byte global header, and each has a 60 byte
+	// header followed by its data, padded to an even length.
+	offset := int64(8)
+	sigOffset := int64(-1)
+	rd := ar.NewReader(d.f)
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return &InvalidDeb{d, err}
+		}
+		if sigOffset >= 0 {
+			err := fmt.Errorf("signature is not the last member")
+			return &InvalidDeb{d, err}
+		}
+		if strings.Trim(hdr.Name, "/") == "_gpgbuilder" {
+			sigOffset = offset
+		}
+		offset += 60 + hdr.Size + hdr.Size%2
+	}
+	if sigOffset < 0 {
+		return nil
+	}
+	return d.f.Truncate(sigOffset)
+}
+
 func (d *Deb) Sign(key string) error {
 	_, err := d.findSection("_gpgbuilder")
 	if _, ok := err.(*NotFound); !ok && err != nil {
@@ -0,0 +1,153 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata are minimal debs, one for each compression format
+// that the control and data members can use.
+var debFlavours = []struct {
+	file    string
+	pkg     string
+	version string
+	arch    string
+	files   []string
+}{
+	{"gz.deb", "hello", "1.0-1", "amd64", []string{"usr/bin/hello", "usr/share/doc/hello/README"}},
+	{"xz.deb", "hello", "1.1-1", "amd64", []string{"usr/bin/hello", "usr/share/doc/hello/README"}},
+	{"zst.deb", "hello", "1.0-1", "arm64", []string{"usr/bin/hello", "usr/share/doc/hello/README"}},
+	{"none.deb", "plain", "0.1", "amd64", []string{"usr/bin/plain", "usr/share/doc/plain/README"}},
+}
+
+func TestControl(t *testing.T) {
+	for _, test := range debFlavours {
+		d, err := Open("testdata/" + test.file)
+		if err != nil {
+			t.Errorf("%s: Open failed: %s", test.file, err)
+			continue
+		}
+		info, err := d.Control("control")
+		d.Close()
+		if err != nil {
+			t.Errorf("%s: Control failed: %s", test.file, err)
+			continue
+		}
+		if len(info) != 1 {
+			t.Errorf("%s: got %d paragraphs, want 1", test.file, len(info))
+			continue
+		}
+		para := info[0]
+		if para["Package"] != test.pkg || para["Version"] != test.version || para["Architecture"] != test.arch {
+			t.Errorf("%s: got %s %s %s, want %s %s %s", test.file,
+				para["Package"], para["Version"], para["Architecture"],
+				test.pkg, test.version, test.arch)
+		}
+		if !strings.HasPrefix(para["Description"], "test pkg "+test.pkg) {
+			t.Errorf("%s: unexpected Description %q", test.file, para["Description"])
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	for _, test := range debFlavours {
+		d, err := Open("testdata/" + test.file)
+		if err != nil {
+			t.Errorf("%s: Open failed: %s", test.file, err)
+			continue
+		}
+		files, err := d.Files()
+		d.Close()
+		if err != nil {
+			t.Errorf("%s: Files failed: %s", test.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%s: got files %q, want %q", test.file, files, test.files)
+		}
+	}
+}
+
+func TestMissingControlFile(t *testing.T) {
+	d, err := Open("testdata/gz.deb")
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer d.Close()
+	_, err = d.Control("no-such-file")
+	if err == nil {
+		t.Errorf("expected an error reading a missing control file")
+	}
+}
+
+func TestDecompressUnknown(t *testing.T) {
+	_, err := Decompress(".lz4", strings.NewReader(""))
+	if err == nil {
+		t.Errorf("expected an error for an unknown compression")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	hash := func(file string) string {
+		d, err := Open("testdata/" + file)
+		if err != nil {
+			t.Fatalf("%s: Open failed: %s", file, err)
+		}
+		defer d.Close()
+		h, err := d.ContentHash()
+		if err != nil {
+			t.Fatalf("%s: ContentHash failed: %s", file, err)
+		}
+		return h
+	}
+	// signed.deb is gz.deb with a _gpgbuilder member appended.
+	if hash("gz.deb") != hash("signed.deb") {
+		t.Errorf("signature changed the content hash")
+	}
+	if hash("gz.deb") == hash("zst.deb") {
+		t.Errorf("different debs have the same content hash")
+	}
+}
+
+func TestUnsign(t *testing.T) {
+	signed, err := ioutil.ReadFile("testdata/signed.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signed.deb")
+	err = ioutil.WriteFile(path, signed, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	// The second call has no signature to remove.
+	for i := 0; i < 2; i++ {
+		err = d.Unsign()
+		if err != nil {
+			t.Fatalf("Unsign %d failed: %s", i+1, err)
+		}
+	}
+	d.Close()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/gz.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("unsigned deb differs from the original")
+	}
+}
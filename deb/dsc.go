@@ -0,0 +1,207 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deb
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qur/godebiancontrol"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// SourceFile is one of the files that make up a source package, as listed in
+// the .dsc file.
+type SourceFile struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	Md5    string `json:"md5"`
+	Sha1   string `json:"sha1"`
+	Sha256 string `json:"sha256"`
+}
+
+// Dsc is a parsed Debian source control (.dsc) file.
+type Dsc struct {
+	name string
+
+	// Control holds the fields of the .dsc, except for the file lists which
+	// are parsed into Files.
+	Control map[string]string
+
+	// Files lists the files referenced by the .dsc (i.e. not including the
+	// .dsc itself).
+	Files []SourceFile
+}
+
+type InvalidDsc struct {
+	name string
+	err  error
+}
+
+func (id *InvalidDsc) Error() string {
+	return fmt.Sprintf("Dsc file '%s' was not valid: %s", id.name, id.err)
+}
+
+// ParseDsc reads the given .dsc file.  If the file is clearsigned then the
+// signature is stripped, but not checked.
+func ParseDsc(filename string) (*Dsc, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := clearsign.Decode(data)
+	if block != nil {
+		data = block.Plaintext
+	}
+	paras, err := godebiancontrol.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, &InvalidDsc{filename, err}
+	}
+	if len(paras) != 1 {
+		err := fmt.Errorf("Expected 1 paragraph, not %d", len(paras))
+		return nil, &InvalidDsc{filename, err}
+	}
+	d := &Dsc{
+		name:    filename,
+		Control: make(map[string]string, len(paras[0])),
+	}
+	for name, value := range paras[0] {
+		d.Control[name] = value
+	}
+	for _, field := range []string{"Source", "Version", "Files"} {
+		if d.Control[field] == "" {
+			err := fmt.Errorf("Missing '%s' field", field)
+			return nil, &InvalidDsc{filename, err}
+		}
+	}
+	err = d.parseFiles()
+	if err != nil {
+		return nil, &InvalidDsc{filename, err}
+	}
+	return d, nil
+}
+
+// parseFileList parses a multi-line file list field, where each line is
+// "<hash> <size> <name>".
+func parseFileList(value string) ([][3]string, error) {
+	var files [][3]string
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid file line: '%s'", strings.TrimSpace(line))
+		}
+		files = append(files, [3]string{fields[0], fields[1], fields[2]})
+	}
+	return files, nil
+}
+
+func (d *Dsc) parseFiles() error {
+	index := make(map[string]int)
+	fields := []struct {
+		name string
+		set  func(f *SourceFile, hash string)
+	}{
+		{"Files", func(f *SourceFile, hash string) { f.Md5 = hash }},
+		{"Checksums-Sha1", func(f *SourceFile, hash string) { f.Sha1 = hash }},
+		{"Checksums-Sha256", func(f *SourceFile, hash string) { f.Sha256 = hash }},
+	}
+	for i, field := range fields {
+		value, found := d.Control[field.name]
+		if !found {
+			continue
+		}
+		delete(d.Control, field.name)
+		files, err := parseFileList(value)
+		if err != nil {
+			return err
+		}
+		for _, info := range files {
+			name := info[2]
+			if name != filepath.Base(name) || name == "." || name == ".." {
+				return fmt.Errorf("Invalid file name: '%s'", name)
+			}
+			size, err := strconv.ParseUint(info[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid size for '%s': %s", name, err)
+			}
+			n, found := index[name]
+			if !found {
+				// Only the Files field may introduce new names, the
+				// checksum fields have to match it.
+				if i != 0 {
+					return fmt.Errorf("'%s' in %s, but not Files", name, field.name)
+				}
+				d.Files = append(d.Files, SourceFile{Name: name, Size: size})
+				n = len(d.Files) - 1
+				index[name] = n
+			} else if d.Files[n].Size != size {
+				return fmt.Errorf("Size mismatch for '%s' in %s", name, field.name)
+			}
+			field.set(&d.Files[n], strings.ToLower(info[0]))
+		}
+	}
+	return nil
+}
+
+// Verify checks that all the files listed in the .dsc are present in dir, and
+// that their sizes and checksums match those given in the .dsc.
+func (d *Dsc) Verify(dir string) error {
+	for _, file := range d.Files {
+		info, err := hashFile(filepath.Join(dir, file.Name))
+		if err != nil {
+			return &InvalidDsc{d.name, err}
+		}
+		switch {
+		case info.Size != file.Size:
+			err = fmt.Errorf("Size mismatch for '%s'", file.Name)
+		case info.Md5 != file.Md5:
+			err = fmt.Errorf("MD5 mismatch for '%s'", file.Name)
+		case file.Sha1 != "" && info.Sha1 != file.Sha1:
+			err = fmt.Errorf("SHA1 mismatch for '%s'", file.Name)
+		case file.Sha256 != "" && info.Sha256 != file.Sha256:
+			err = fmt.Errorf("SHA256 mismatch for '%s'", file.Name)
+		}
+		if err != nil {
+			return &InvalidDsc{d.name, err}
+		}
+	}
+	return nil
+}
+
+// hashFile returns the size and checksums of the given file.
+func hashFile(filename string) (*SourceFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h1 := sha1.New()
+	h256 := sha256.New()
+	h5 := md5.New()
+	size, err := io.Copy(io.MultiWriter(h1, h256, h5), f)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceFile{
+		Name:   filepath.Base(filename),
+		Size:   uint64(size),
+		Md5:    hex.EncodeToString(h5.Sum(nil)),
+		Sha1:   hex.EncodeToString(h1.Sum(nil)),
+		Sha256: hex.EncodeToString(h256.Sum(nil)),
+	}, nil
+}
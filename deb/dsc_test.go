@@ -0,0 +1,181 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sourceFiles are the files of the test source package, and their contents.
+var sourceFiles = []struct {
+	name, data string
+}{
+	{"hello_1.0.orig.tar.gz", "orig tarball"},
+	{"hello_1.0-1.debian.tar.xz", "debian tarball"},
+}
+
+// fileLists returns the Files, Checksums-Sha1 and Checksums-Sha256 fields for
+// sourceFiles, each line starting with a newline.
+func fileLists(t *testing.T, dir string) (files, sha1s, sha256s string) {
+	for _, file := range sourceFiles {
+		path := filepath.Join(dir, file.name)
+		err := ioutil.WriteFile(path, []byte(file.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := hashFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files += fmt.Sprintf("\n %s %d %s", info.Md5, info.Size, info.Name)
+		sha1s += fmt.Sprintf("\n %s %d %s", info.Sha1, info.Size, info.Name)
+		sha256s += fmt.Sprintf("\n %s %d %s", info.Sha256, info.Size, info.Name)
+	}
+	return files, sha1s, sha256s
+}
+
+// writeDsc writes a .dsc for sourceFiles into dir, with the given file lists.
+func writeDsc(t *testing.T, dir, files, sha1s, sha256s string) string {
+	text := "Format: 3.0 (quilt)\nSource: hello\nBinary: hello\nVersion: 1.0-1\n"
+	text += "Files:" + files + "\n"
+	if sha1s != "" {
+		text += "Checksums-Sha1:" + sha1s + "\n"
+	}
+	if sha256s != "" {
+		text += "Checksums-Sha256:" + sha256s + "\n"
+	}
+	path := filepath.Join(dir, "hello_1.0-1.dsc")
+	err := ioutil.WriteFile(path, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseDsc(t *testing.T) {
+	dir := t.TempDir()
+	files, sha1s, sha256s := fileLists(t, dir)
+	d, err := ParseDsc(writeDsc(t, dir, files, sha1s, sha256s))
+	if err != nil {
+		t.Fatalf("ParseDsc failed: %s", err)
+	}
+	wantControl := map[string]string{
+		"Format":  "3.0 (quilt)",
+		"Source":  "hello",
+		"Binary":  "hello",
+		"Version": "1.0-1",
+	}
+	if !reflect.DeepEqual(d.Control, wantControl) {
+		t.Errorf("got Control %q, want %q", d.Control, wantControl)
+	}
+	if len(d.Files) != len(sourceFiles) {
+		t.Fatalf("got %d files, want %d", len(d.Files), len(sourceFiles))
+	}
+	for i, file := range sourceFiles {
+		want, err := hashFile(filepath.Join(dir, file.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Files[i] != *want {
+			t.Errorf("got file %+v, want %+v", d.Files[i], *want)
+		}
+	}
+	err = d.Verify(dir)
+	if err != nil {
+		t.Errorf("Verify failed: %s", err)
+	}
+
+	// The checksum fields are optional.
+	d, err = ParseDsc(writeDsc(t, dir, files, "", ""))
+	if err != nil {
+		t.Fatalf("ParseDsc without checksums failed: %s", err)
+	}
+	if d.Files[0].Md5 == "" || d.Files[0].Sha256 != "" {
+		t.Errorf("got file %+v, want only an MD5", d.Files[0])
+	}
+}
+
+func TestParseInvalidDsc(t *testing.T) {
+	dir := t.TempDir()
+	files, sha1s, sha256s := fileLists(t, dir)
+	tests := []struct {
+		what                  string
+		files, sha1s, sha256s string
+	}{
+		{"a name only in Checksums-Sha256", files, sha1s,
+			sha256s + "\n " + strings.Repeat("0", 64) + " 1 extra.tar.gz"},
+		{"a name with a directory", strings.Replace(files, " hello_1.0.orig", " sub/hello_1.0.orig", 1), "", ""},
+		{"a name outside the directory", files + "\n 00000000000000000000000000000000 1 ../x", "", ""},
+		{"a size mismatch between fields", files, strings.Replace(sha1s, " 12 ", " 13 ", 1), ""},
+		{"a short file line", files + "\n 00000000000000000000000000000000 x", "", ""},
+		{"an invalid size", files + "\n 00000000000000000000000000000000 big x", "", ""},
+	}
+	for _, test := range tests {
+		_, err := ParseDsc(writeDsc(t, dir, test.files, test.sha1s, test.sha256s))
+		if _, ok := err.(*InvalidDsc); !ok {
+			t.Errorf("%s: got error %v, want *InvalidDsc", test.what, err)
+		}
+	}
+
+	path := filepath.Join(dir, "empty.dsc")
+	err := ioutil.WriteFile(path, []byte("Source: hello\nVersion: 1.0-1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseDsc(path)
+	if _, ok := err.(*InvalidDsc); !ok {
+		t.Errorf("no Files: got error %v, want *InvalidDsc", err)
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	dir := t.TempDir()
+	files, sha1s, sha256s := fileLists(t, dir)
+	d, err := ParseDsc(writeDsc(t, dir, files, sha1s, sha256s))
+	if err != nil {
+		t.Fatalf("ParseDsc failed: %s", err)
+	}
+	orig := filepath.Join(dir, sourceFiles[0].name)
+
+	// Same size, different contents.
+	err = ioutil.WriteFile(orig, []byte(strings.ToUpper(sourceFiles[0].data)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Verify(dir)
+	if err == nil || !strings.Contains(err.Error(), "MD5 mismatch") {
+		t.Errorf("changed file: got %v, want an MD5 mismatch", err)
+	}
+
+	// The MD5 matches, but not the SHA256.
+	err = ioutil.WriteFile(orig, []byte(sourceFiles[0].data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Files[0].Sha256 = strings.Repeat("0", 64)
+	err = d.Verify(dir)
+	if err == nil || !strings.Contains(err.Error(), "SHA256 mismatch") {
+		t.Errorf("bad SHA256: got %v, want a SHA256 mismatch", err)
+	}
+
+	err = ioutil.WriteFile(orig, []byte("short"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Verify(dir)
+	if err == nil || !strings.Contains(err.Error(), "Size mismatch") {
+		t.Errorf("truncated file: got %v, want a size mismatch", err)
+	}
+
+	err = d.Verify(t.TempDir())
+	if _, ok := err.(*InvalidDsc); !ok {
+		t.Errorf("missing files: got error %v, want *InvalidDsc", err)
+	}
+}
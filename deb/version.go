@@ -0,0 +1,194 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a Debian package version, split into its component parts.  The
+// version string is [epoch:]upstream_version[-debian_revision].
+type Version struct {
+	Epoch    uint64
+	Upstream string
+	Revision string
+}
+
+type InvalidVersion struct {
+	version string
+	reason  string
+}
+
+func (iv *InvalidVersion) Error() string {
+	return fmt.Sprintf("Version '%s' was not valid: %s", iv.version, iv.reason)
+}
+
+// ParseVersion parses and validates a version string, following the rules in
+// Debian policy section 5.6.12.
+func ParseVersion(s string) (Version, error) {
+	invalid := func(format string, args ...interface{}) (Version, error) {
+		return Version{}, &InvalidVersion{s, fmt.Sprintf(format, args...)}
+	}
+	if s == "" {
+		return invalid("empty version")
+	}
+	if strings.TrimSpace(s) != s {
+		return invalid("leading or trailing whitespace")
+	}
+	v := splitVersion(s)
+	if i := strings.Index(s, ":"); i >= 0 {
+		if i == 0 {
+			return invalid("empty epoch")
+		}
+		epoch, err := strconv.ParseUint(s[:i], 10, 32)
+		if err != nil {
+			return invalid("epoch is not a number")
+		}
+		v.Epoch = epoch
+	}
+	if v.Upstream == "" {
+		return invalid("empty upstream version")
+	}
+	if !isDigit(v.Upstream[0]) {
+		return invalid("upstream version does not start with a digit")
+	}
+	for _, c := range []byte(v.Upstream) {
+		if !isAlnum(c) && !strings.ContainsRune(".+-~", rune(c)) {
+			return invalid("invalid character '%c' in upstream version", c)
+		}
+	}
+	if strings.HasSuffix(s, "-") {
+		return invalid("empty revision")
+	}
+	for _, c := range []byte(v.Revision) {
+		if !isAlnum(c) && !strings.ContainsRune(".+~", rune(c)) {
+			return invalid("invalid character '%c' in revision", c)
+		}
+	}
+	return v, nil
+}
+
+// String returns the version in the standard form.  The epoch is only
+// included if it is not zero.
+func (v Version) String() string {
+	s := v.Upstream
+	if v.Epoch != 0 {
+		s = fmt.Sprintf("%d:%s", v.Epoch, s)
+	}
+	if v.Revision != "" {
+		s += "-" + v.Revision
+	}
+	return s
+}
+
+// Compare compares two versions using the same rules as dpkg, returning a
+// negative number if v < o, zero if v == o, and a positive number if v > o.
+func (v Version) Compare(o Version) int {
+	if v.Epoch != o.Epoch {
+		if v.Epoch < o.Epoch {
+			return -1
+		}
+		return 1
+	}
+	if c := compareFragment(v.Upstream, o.Upstream); c != 0 {
+		return c
+	}
+	return compareFragment(v.Revision, o.Revision)
+}
+
+// CompareVersions compares two version strings, as Version.Compare does.  The
+// versions are not validated, so that versions that are already in a repo can
+// always be ordered - malformed parts are compared as well as possible.
+func CompareVersions(a, b string) int {
+	return splitVersion(a).Compare(splitVersion(b))
+}
+
+// splitVersion splits a version string into epoch, upstream version and
+// Debian revision without validating it.  A malformed epoch is treated as
+// zero.
+func splitVersion(s string) Version {
+	v := Version{}
+	if i := strings.Index(s, ":"); i >= 0 {
+		v.Epoch, _ = strconv.ParseUint(s[:i], 10, 32)
+		s = s[i+1:]
+	}
+	if i := strings.LastIndex(s, "-"); i >= 0 {
+		v.Revision = s[i+1:]
+		s = s[:i]
+	}
+	v.Upstream = s
+	return v
+}
+
+// order returns the sort weight of a character in the non-digit parts of a
+// version.  Letters sort before non-letters, and ~ sorts before everything,
+// even the end of the string.
+func order(c byte) int {
+	switch {
+	case isDigit(c):
+		return 0
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// compareFragment compares upstream versions or revisions, alternating
+// between comparing non-digit and digit runs as described in Debian policy.
+func compareFragment(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = order(a[i])
+			}
+			if j < len(b) {
+				bc = order(b[j])
+			}
+			if ac != bc {
+				return ac - bc
+			}
+			i++
+			j++
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		diff := 0
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if diff == 0 {
+				diff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if diff != 0 {
+			return diff
+		}
+	}
+	return 0
+}
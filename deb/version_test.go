@@ -0,0 +1,110 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package deb
+
+import (
+	"testing"
+)
+
+// The expected results are those given by dpkg --compare-versions.
+var versionOrder = []struct {
+	a, b string
+	cmp  int
+}{
+	{"1.0", "1.0", 0},
+	{"1.0", "1.1", -1},
+	{"1.10", "1.9", 1},
+	{"1.01", "1.1", 0},
+	{"1.0", "1.0.0", -1},
+	{"1.0a", "1.0", 1},
+	{"1.0a", "1.0b", -1},
+	{"1.0a", "1.0+", -1},
+	{"1.0+", "1.0.", -1},
+	{"1.0~rc1", "1.0", -1},
+	{"1.0~rc1", "1.0~rc2", -1},
+	{"1.0~~", "1.0~", -1},
+	{"1.0~", "1.0~a", -1},
+	{"1:0.1", "2.0", 1},
+	{"0:1.0", "1.0", 0},
+	{"1:1.0", "2:0.1", -1},
+	{"1.0-1", "1.0-2", -1},
+	{"1.0-10", "1.0-9", 1},
+	{"1.0", "1.0-0", 0},
+	{"1.0-1", "1.0-1~bpo1", 1},
+	{"1.0-1ubuntu1", "1.0-1", 1},
+	{"1.0-1-1", "1.0-1", 1},
+	{"2.0-1", "10.0-1", -1},
+	{"1.0+dfsg-1", "1.0-1", 1},
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range versionOrder {
+		if got := sign(CompareVersions(test.a, test.b)); got != test.cmp {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.cmp)
+		}
+		if got := sign(CompareVersions(test.b, test.a)); got != -test.cmp {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.cmp)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    Version
+	}{
+		{"1.0", Version{0, "1.0", ""}},
+		{"1.0-1", Version{0, "1.0", "1"}},
+		{"2:1.0-1", Version{2, "1.0", "1"}},
+		{"1.0-1-2", Version{0, "1.0-1", "2"}},
+		{"1.0~rc1+dfsg-0ubuntu1~bpo1", Version{0, "1.0~rc1+dfsg", "0ubuntu1~bpo1"}},
+	}
+	for _, test := range tests {
+		v, err := ParseVersion(test.version)
+		if err != nil {
+			t.Errorf("ParseVersion(%q) failed: %s", test.version, err)
+			continue
+		}
+		if v != test.want {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", test.version, v, test.want)
+		}
+		if v.String() != test.version {
+			t.Errorf("ParseVersion(%q).String() = %q", test.version, v.String())
+		}
+	}
+}
+
+func TestParseInvalidVersion(t *testing.T) {
+	for _, version := range []string{
+		"",
+		" 1.0",
+		"1.0 ",
+		":1.0",
+		"a:1.0",
+		"1:",
+		"a1.0",
+		"1.0-",
+		"1.0_1",
+		"1.0-1:2",
+		"1.0-1_2",
+	} {
+		_, err := ParseVersion(version)
+		if err == nil {
+			t.Errorf("ParseVersion(%q) succeeded, want an error", version)
+		} else if _, ok := err.(*InvalidVersion); !ok {
+			t.Errorf("ParseVersion(%q) returned %T, want *InvalidVersion", version, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// binaryFieldOrder is the order that dpkg writes the fields of a Packages
+// stanza in.
+var binaryFieldOrder = []string{
+	"Package", "Package-Type", "Source", "Version", "Built-Using",
+	"Static-Built-Using", "Kernel-Version", "Built-For-Profiles",
+	"Auto-Built-Package", "Architecture", "Subarchitecture",
+	"Installer-Menu-Item", "Build-Essential", "Essential", "Protected",
+	"Origin", "Bugs", "Maintainer", "Original-Maintainer", "Installed-Size",
+	"Pre-Depends", "Depends", "Recommends", "Suggests", "Breaks", "Conflicts",
+	"Enhances", "Replaces", "Provides", "Filename", "Size", "MD5sum", "SHA1",
+	"SHA256", "Section", "Priority", "Multi-Arch", "Homepage", "Description",
+	"Description-md5", "Tag", "Task",
+}
+
+// sourceFieldOrder is the order that dpkg writes the fields of a Sources
+// stanza in.
+var sourceFieldOrder = []string{
+	"Package", "Format", "Binary", "Architecture", "Version", "Priority",
+	"Section", "Origin", "Maintainer", "Uploaders", "Homepage",
+	"Standards-Version", "Vcs-Browser", "Vcs-Arch", "Vcs-Bzr", "Vcs-Cvs",
+	"Vcs-Darcs", "Vcs-Git", "Vcs-Hg", "Vcs-Mtn", "Vcs-Svn", "Testsuite",
+	"Testsuite-Triggers", "Build-Depends", "Build-Depends-Arch",
+	"Build-Depends-Indep", "Build-Conflicts", "Build-Conflicts-Arch",
+	"Build-Conflicts-Indep", "Package-List", "Directory", "Files",
+	"Checksums-Sha1", "Checksums-Sha256",
+}
+
+// formatStanza formats the given fields as an index stanza (without the
+// trailing blank line).  Fields named in order are written first, in that
+// order, followed by any others sorted by name.  Field names are matched case
+// insensitively, as they are by dpkg.
+func formatStanza(fields map[string]string, order []string) string {
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		rank[strings.ToLower(name)] = i
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ri, iok := rank[strings.ToLower(names[i])]
+		rj, jok := rank[strings.ToLower(names[j])]
+		switch {
+		case iok && jok:
+			return ri < rj
+		case iok != jok:
+			return iok
+		}
+		return names[i] < names[j]
+	})
+	s := ""
+	for _, name := range names {
+		s += formatField(name, fields[name])
+	}
+	return s
+}
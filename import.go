@@ -0,0 +1,162 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ImportResult reports what happened to one of the files in a bulk import.
+type ImportResult struct {
+	File  string `json:"file"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// added is the package that was imported, if OK is true.
+	added pkgVersion
+}
+
+// importDeb adds a single .deb, read from rd, to the repo without saving it.
+// Problems with the .deb itself are reported in the result, rather than
+// returned as an error.  If the .deb can't be read then the error is both
+// reported in the result and returned, as the caller may not be able to carry
+// on (e.g. if rd is a broken tar stream).
+func (r *Repo) importDeb(name string, rd io.Reader, codename, component string) (ImportResult, error) {
+	result := ImportResult{File: name}
+	dir, debPath, hw, err := saveUpload(r.Name, path.Base(name), rd)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	result.added, err = r.addDeb(debPath, hw, codename, component)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.OK = true
+	return result, nil
+}
+
+// finishImport applies the retention policy and saves the repo, if anything
+// was imported.  The imported versions are never pruned.
+func (r *Repo) finishImport(results []ImportResult) error {
+	var added []pkgVersion
+	for _, result := range results {
+		if result.OK {
+			added = append(added, result.added)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	_, removed := r.prune(added...)
+	return r.saveAndRemove(removed)
+}
+
+// abortImport saves the repo if anything was imported before the error err
+// stopped the import, as the imported debs are already in the pool.  err is
+// returned, along with the save error if that fails too.
+func (r *Repo) abortImport(results []ImportResult, err error) error {
+	saveErr := r.finishImport(results)
+	if saveErr != nil {
+		log.Printf("Failed to save packages imported before error '%s': %s\n", err, saveErr)
+		return fmt.Errorf("%s (and saving the imported packages failed: %s)", err, saveErr)
+	}
+	return err
+}
+
+// ImportDir adds all the .debs found under dir to the given dist and
+// component, saving the repo once at the end.  The files are copied, so dir
+// is left untouched.  Files and subdirectories that can't be read are
+// reported in the results.
+func (r *Repo) ImportDir(dir, codename, component string) ([]ImportResult, error) {
+	results := []ImportResult{}
+	err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if filename == dir {
+				return err
+			}
+			results = append(results, ImportResult{File: filename, Error: err.Error()})
+			return nil
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(filename, ".deb") {
+			return nil
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			results = append(results, ImportResult{File: filename, Error: err.Error()})
+			return nil
+		}
+		defer f.Close()
+		// The error is already in the result, and there is no reason not
+		// to carry on with the next file.
+		result, _ := r.importDeb(filename, f, codename, component)
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to import from '%s': %s\n", dir, err)
+		return nil, err
+	}
+	return results, r.finishImport(results)
+}
+
+// ImportTar adds all the .debs in a tar stream (which may be gzipped) to the
+// given dist and component, saving the repo once at the end.  If maxSize is
+// not 0, then larger .debs are rejected.  If the stream can't be read then
+// the results so far are returned along with the error.
+func (r *Repo) ImportTar(rd io.Reader, maxSize int64, codename, component string) ([]ImportResult, error) {
+	br := bufio.NewReader(rd)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		rd = gz
+	} else {
+		rd = br
+	}
+	results := []ImportResult{}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Failed to read import tar stream: %s\n", err)
+			return results, r.abortImport(results, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ".deb") {
+			continue
+		}
+		if maxSize > 0 && hdr.Size > maxSize {
+			results = append(results, ImportResult{
+				File:  hdr.Name,
+				Error: fmt.Sprintf("larger than %d bytes", maxSize),
+			})
+			continue
+		}
+		result, err := r.importDeb(hdr.Name, tr, codename, component)
+		results = append(results, result)
+		if err != nil {
+			return results, r.abortImport(results, err)
+		}
+	}
+	return results, r.finishImport(results)
+}
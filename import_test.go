@@ -0,0 +1,76 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// importTar returns a tar stream holding the given debs from deb/testdata.
+func importTar(t *testing.T, debs ...string) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, name := range debs {
+		data, err := ioutil.ReadFile("deb/testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// A broken tar stream stops the import, but the debs before the break are
+// still saved and reported.
+func TestImportTruncatedTar(t *testing.T) {
+	setupTestDirs(t)
+	newTestRepo(t, "import", nil)
+	stream := importTar(t, "gz.deb", "xz.deb")
+	// Drop the two zero blocks that end the stream, and part of xz.deb.
+	stream = stream[:len(stream)-1024-600]
+
+	req := httptest.NewRequest("POST", "/c/import/import", bytes.NewReader(stream))
+	w := httptest.NewRecorder()
+	handleControlRequest(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var resp ImportResp
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if resp.Error == "" {
+		t.Errorf("no error in the response")
+	}
+	if len(resp.Results) != 2 || !resp.Results[0].OK || resp.Results[1].OK {
+		t.Errorf("got results %+v, want gz.deb ok and xz.deb failed", resp.Results)
+	}
+
+	r, err := LoadRepo("import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := r.find(r.Config.Codename, "main", "amd64", "hello", "1.0-1"); !found {
+		t.Errorf("deb imported before the break wasn't saved")
+	}
+}
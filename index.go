@@ -0,0 +1,164 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type compression struct {
+	ext       string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// compressions are the formats that index files can be written in, keyed by
+// the name used in the repo config.
+var compressions = map[string]compression{
+	"none": {"", func(w io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	}},
+	"gz": {".gz", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	}},
+	"xz": {".xz", func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	}},
+	"bz2": {".bz2", func(w io.Writer) (io.WriteCloser, error) {
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: bzip2.BestCompression})
+	}},
+	"zst": {".zst", func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithZeroFrames(true))
+	}},
+}
+
+var defaultCompressions = []string{"none", "gz"}
+
+// checkCompressions validates a list of index compressions for use in a
+// RepoConfig.
+func checkCompressions(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no compressions given")
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, found := compressions[name]; !found {
+			return fmt.Errorf("unknown compression: '%s'", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("compression listed twice: '%s'", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// indexWriter writes an index file (e.g. Packages) in each of the configured
+// compression formats at once.  The hashes of each file written are stored in
+// the repo when the indexWriter is closed.
+type indexWriter struct {
+	r         *Repo
+	codename  string
+	filenames []string
+	files     []*os.File
+	hws       []*HashWriter
+	cws       []io.WriteCloser
+	w         io.Writer
+}
+
+// newIndexWriter creates a writer for the index file with the given filename,
+// which will be written in each of the given compressions.
+func (r *Repo) newIndexWriter(codename, filename string, names []string) (*indexWriter, error) {
+	iw := &indexWriter{
+		r:        r,
+		codename: codename,
+	}
+	writers := make([]io.Writer, 0, len(names))
+	for _, name := range names {
+		c := compressions[name]
+		path := filename + c.ext
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("Failed to create '%s': %s\n", path, err)
+			iw.abort()
+			return nil, err
+		}
+		hw := NewHashWriter(f)
+		cw, err := c.newWriter(hw)
+		if err != nil {
+			log.Printf("Failed to create %s writer for '%s': %s\n", name, path, err)
+			f.Close()
+			iw.abort()
+			return nil, err
+		}
+		iw.filenames = append(iw.filenames, path)
+		iw.files = append(iw.files, f)
+		iw.hws = append(iw.hws, hw)
+		iw.cws = append(iw.cws, cw)
+		writers = append(writers, cw)
+	}
+	iw.w = io.MultiWriter(writers...)
+	return iw, nil
+}
+
+func (iw *indexWriter) Write(p []byte) (int, error) {
+	return iw.w.Write(p)
+}
+
+// abort closes all the files without storing any hashes.
+func (iw *indexWriter) abort() {
+	for i := range iw.files {
+		iw.cws[i].Close()
+		iw.files[i].Close()
+	}
+}
+
+// Close finishes writing all of the files, and stores their hashes in the
+// repo.
+func (iw *indexWriter) Close() error {
+	var firstErr error
+	for i, f := range iw.files {
+		// We must close the compressing writer so all its output goes to the
+		// HashWriter.  A flush is not sufficient (extra bytes get written on
+		// Close).
+		err := iw.cws[i].Close()
+		if err != nil {
+			log.Printf("Failed to finish '%s': %s\n", iw.filenames[i], err)
+		}
+		err2 := f.Close()
+		if err2 != nil {
+			log.Printf("Failed to close '%s': %s\n", iw.filenames[i], err2)
+		}
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		err = iw.r.storeHashes(iw.codename, iw.filenames[i], iw.hws[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
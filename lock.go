@@ -0,0 +1,89 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// repoLock is the in-process lock for a repo.  refs counts the goroutines
+// holding or waiting for the lock, and is protected by repoLocks.
+type repoLock struct {
+	sync.Mutex
+	refs int
+}
+
+// repoLocks holds a lock for each repo that is in use, so that only one
+// goroutine at a time can load, modify and save a given repo.  Entries are
+// removed once nothing is using them, so that the map doesn't grow with every
+// temporary repo.
+var repoLocks = struct {
+	sync.Mutex
+	locks map[string]*repoLock
+}{locks: make(map[string]*repoLock)}
+
+// lockRepo takes the lock for the named repo, which must be held while the
+// repo is modified (i.e. from before it is loaded until after it has been
+// saved).  As well as the in-process lock, an flock is taken on the .lock file
+// in the repo directory so that other processes sharing the repos are also
+// excluded.  If the repo doesn't exist then the error will satisfy
+// os.IsNotExist.  The returned function releases the lock.
+func lockRepo(name string) (func(), error) {
+	repoLocks.Lock()
+	l, found := repoLocks.locks[name]
+	if !found {
+		l = new(repoLock)
+		repoLocks.locks[name] = l
+	}
+	l.refs++
+	repoLocks.Unlock()
+
+	l.Lock()
+	path := filepath.Join(repoPath, name, ".lock")
+	f, err := flock(path)
+	if err != nil {
+		unlockRepo(name, l)
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to lock '%s': %s\n", path, err)
+		}
+		return nil, err
+	}
+	return func() {
+		// Closing the file releases the flock.
+		f.Close()
+		unlockRepo(name, l)
+	}, nil
+}
+
+// unlockRepo releases the in-process lock l for the named repo, dropping it
+// from repoLocks if nothing else is waiting for it.
+func unlockRepo(name string, l *repoLock) {
+	l.Unlock()
+	repoLocks.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(repoLocks.locks, name)
+	}
+	repoLocks.Unlock()
+}
+
+// flock opens the file at path, creating it if required, and takes an
+// exclusive flock on it.  Closing the returned file releases the lock.
+func flock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setupTestDirs points the repo and tmp directories at a new temporary
+// directory, which is returned.
+func setupTestDirs(t *testing.T) string {
+	dir := t.TempDir()
+	repoPath = filepath.Join(dir, "repos")
+	tmpPath = filepath.Join(dir, "tmp")
+	for _, path := range []string{repoPath, tmpPath} {
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// controlRequest sends a request to the control API, and returns the response
+// status.
+func controlRequest(t *testing.T, method, path, body string) int {
+	var req *http.Request
+	if strings.HasPrefix(body, "@") {
+		f, err := os.Open(body[1:])
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer f.Close()
+		req = httptest.NewRequest(method, path, f)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+	}
+	w := httptest.NewRecorder()
+	handleControlRequest(w, req)
+	return w.Code
+}
+
+func TestParallelIncludeRemove(t *testing.T) {
+	setupTestDirs(t)
+	const dists = 10
+	r := newRepo("hammer")
+	r.Config.Architectures = []string{"amd64"}
+	r.Config.Codenames = nil
+	for i := 0; i < dists; i++ {
+		r.Config.Codenames = append(r.Config.Codenames, fmt.Sprintf("d%d", i))
+	}
+	r.Config.Codename = "d0"
+	err := r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parallel runs fn for each dist at the same time.
+	parallel := func(fn func(codename string, i int)) {
+		var wg sync.WaitGroup
+		for i, codename := range r.Config.Codenames {
+			wg.Add(1)
+			go func(codename string, i int) {
+				defer wg.Done()
+				fn(codename, i)
+			}(codename, i)
+		}
+		wg.Wait()
+	}
+
+	parallel(func(codename string, i int) {
+		code := controlRequest(t, "POST", "/c/include/hammer/hello.deb?dist="+codename, "@deb/testdata/gz.deb")
+		if code != http.StatusOK {
+			t.Errorf("include into %s: got %d", codename, code)
+		}
+	})
+	// Now remove the package from half of the dists, while adding a new
+	// version to the rest.
+	parallel(func(codename string, i int) {
+		var code int
+		if i%2 == 0 {
+			body := fmt.Sprintf(`{"name": "hello", "version": "1.0-1", "dists": ["%s"]}`, codename)
+			code = controlRequest(t, "POST", "/c/remove/hammer", body)
+		} else {
+			code = controlRequest(t, "POST", "/c/include/hammer/hello.deb?dist="+codename, "@deb/testdata/xz.deb")
+		}
+		if code != http.StatusOK {
+			t.Errorf("update of %s: got %d", codename, code)
+		}
+	})
+
+	r, err = LoadRepo("hammer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, codename := range r.Config.Codenames {
+		for _, version := range []string{"1.0-1", "1.1-1"} {
+			_, found := r.find(codename, "main", "amd64", "hello", version)
+			if found != (i%2 == 1) {
+				t.Errorf("%s: %s found = %v, want %v", codename, version, found, i%2 == 1)
+			}
+		}
+	}
+	_, err = os.Stat(filepath.Join(repoPath, "hammer", "pool/main/h/hello/hello_1.0-1_amd64.deb"))
+	if err != nil {
+		t.Errorf("pool file still in use was removed: %s", err)
+	}
+}
+
+func TestRepoLocksDropped(t *testing.T) {
+	setupTestDirs(t)
+	for _, name := range []string{"@tmp1", "@tmp2"} {
+		r := newRepo(name)
+		err := r.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := controlRequest(t, "POST", "/c/delete/"+name, "")
+		if code != http.StatusOK {
+			t.Errorf("delete %s: got %d", name, code)
+		}
+	}
+	// Locking a repo that doesn't exist fails, but mustn't leave an entry
+	// behind either.
+	_, err := lockRepo("missing")
+	if !os.IsNotExist(err) {
+		t.Errorf("locking missing repo: got %v", err)
+	}
+	repoLocks.Lock()
+	defer repoLocks.Unlock()
+	if len(repoLocks.locks) != 0 {
+		t.Errorf("%d locks left in repoLocks", len(repoLocks.locks))
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -17,14 +18,24 @@ var (
 	repoPath  = "repos"
 	filesPath = "files"
 	tmpPath   = "tmp"
+	storePath = ""
 )
 
 var cwd = flag.String("dir", ".", "Change to this directory before doing anything.")
+var importDir = flag.String("import", "", "Import all the .debs under this directory into -repo, and then exit.")
+var importRepo = flag.String("repo", "", "The repo to import into.")
+var importDist = flag.String("dist", "", "The dist to import into (defaults to the repo's default codename).")
+var importComponent = flag.String("component", "", "The component to import into (defaults to the repo's default component).")
+var migrate = flag.Bool("migrate", false, "Copy the metadata of all repos from their .meta files into the configured metadata store, and then exit.")
 
 var cfg *Config
 var names = make(chan string)
 var manageOnly = false
 
+// maxUploadSize is the largest request body accepted by include, or 0 for no
+// limit.
+var maxUploadSize int64
+
 func loadConfig() string {
 	cfgPath := "config.yml"
 	if flag.NArg() > 0 {
@@ -71,17 +82,56 @@ func loadConfig() string {
 		log.Printf("Error loading config 'path.tmp': %s\n", err)
 		os.Exit(1)
 	}
+	storePath, err = cfg.Get("path.store", storePath)
+	if err != nil {
+		log.Printf("Error loading config 'path.store': %s\n", err)
+		os.Exit(1)
+	}
+	err = openMetadataStore()
+	if err != nil {
+		log.Printf("Error loading config 'metadata': %s\n", err)
+		os.Exit(1)
+	}
+	err = openBlobStore()
+	if err != nil {
+		log.Printf("Error loading config 'storage': %s\n", err)
+		os.Exit(1)
+	}
+	maxUpload, err := cfg.Get("max-upload-size", "0")
+	if err == nil {
+		maxUploadSize, err = parseSize(maxUpload)
+	}
+	if err != nil {
+		log.Printf("Error loading config 'max-upload-size': %s\n", err)
+		os.Exit(1)
+	}
+	err = loadAuth()
+	if err != nil {
+		log.Printf("Error loading config 'auth': %s\n", err)
+		os.Exit(1)
+	}
 	return listen
 }
 
 func prepPaths() {
-	for _, dir := range []string{repoPath, filesPath, tmpPath} {
+	dirs := []string{repoPath, filesPath, tmpPath}
+	if storePath != "" {
+		dirs = append(dirs, storePath)
+	}
+	for _, dir := range dirs {
 		err := os.MkdirAll(dir, 0755)
 		if err != nil {
 			log.Printf("Failed to create '%s': %s\n", dir, err)
 			os.Exit(1)
 		}
 	}
+	if storePath != "" {
+		err := checkStore()
+		if err != nil {
+			log.Printf("Error loading config 'path.store': %s\n", err)
+			os.Exit(1)
+		}
+	}
 }
 
 func prepRepos() {
@@ -97,6 +147,9 @@ func prepRepos() {
 			os.Exit(1)
 		}
 		_, ok = entry["codename"]
+		if !ok {
+			_, ok = entry["codenames"]
+		}
 		if !ok {
 			log.Printf("Repo entry %d, missing codename!\n", i+1)
 			os.Exit(1)
@@ -109,6 +162,70 @@ func prepRepos() {
 	}
 }
 
+// runImport imports the .debs from the -import directory, printing the result
+// for each file.  It returns the exit status.
+func runImport() int {
+	if *importRepo == "" {
+		log.Printf("-repo must be given with -import\n")
+		return 2
+	}
+	unlock, err := lockRepo(*importRepo)
+	if err != nil {
+		log.Printf("Failed to lock repo '%s': %s\n", *importRepo, err)
+		return 1
+	}
+	defer unlock()
+	repo, err := LoadRepo(*importRepo)
+	if err != nil {
+		return 1
+	}
+	codename, component := *importDist, *importComponent
+	if codename == "" {
+		codename = repo.Config.Codename
+	}
+	if component == "" {
+		component = repo.Config.Component
+	}
+	if !repo.hasDist(codename) || !repo.hasComponent(component) {
+		log.Printf("Unknown dist or component: %s/%s\n", codename, component)
+		return 2
+	}
+	results, err := repo.ImportDir(*importDir, codename, component)
+	status := 0
+	for _, result := range results {
+		if result.OK {
+			fmt.Printf("ok      %s\n", result.File)
+		} else {
+			fmt.Printf("FAILED  %s: %s\n", result.File, result.Error)
+			status = 1
+		}
+	}
+	if err != nil {
+		log.Printf("Import failed: %s\n", err)
+		return 1
+	}
+	return status
+}
+
+// runMigrate copies the metadata from the .meta files into the configured
+// metadata store.  The server should not be running at the same time.  It
+// returns the exit status.
+func runMigrate() int {
+	if _, ok := metaStore.(jsonStore); ok {
+		log.Printf("Metadata is already stored in .meta files\n")
+		return 2
+	}
+	migrated, err := migrateMetadata(metaStore)
+	for _, name := range migrated {
+		fmt.Printf("migrated  %s\n", name)
+	}
+	if err != nil {
+		log.Printf("Failed to migrate metadata: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
 func main() {
 	flag.Parse()
 	err := os.Chdir(*cwd)
@@ -117,14 +234,34 @@ func main() {
 		os.Exit(1)
 	}
 	listen := loadConfig()
+	tr, err := loadTLS()
+	if err != nil {
+		log.Printf("Error loading TLS config: %s\n", err)
+		os.Exit(1)
+	}
 	prepPaths()
+	if *migrate {
+		os.Exit(runMigrate())
+	}
 	prepRepos()
+	if *importDir != "" {
+		os.Exit(runImport())
+	}
 	go randNameGen(names)
+	go refreshReleases()
 	if !manageOnly {
 		http.Handle("/", http.FileServer(http.Dir(filesPath)))
-		http.Handle("/r/", http.StripPrefix("/r/", http.FileServer(http.Dir(repoPath))))
+		http.Handle("/r/", http.StripPrefix("/r/", blobStore.Handler()))
 	}
 	http.HandleFunc("/c/", handleControlRequest)
 	log.Printf("-- start web server --\n")
-	log.Fatal(http.ListenAndServe(listen, nil))
+	if tr == nil {
+		log.Fatal(http.ListenAndServe(listen, nil))
+	}
+	go tr.watch()
+	server := &http.Server{
+		Addr:      listen,
+		TLSConfig: tr.serverConfig(),
+	}
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,153 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// MetadataStore stores the state of the repos - i.e. their config, and the
+// details of their packages and index files.  The files themselves are always
+// stored in the repo directories.
+type MetadataStore interface {
+	// Exists returns true if there is metadata for the named repo.
+	Exists(name string) (bool, error)
+
+	// Load reads the metadata for r.Name into r.  If there is no metadata
+	// for the repo then the error will satisfy os.IsNotExist.
+	Load(r *Repo) error
+
+	// Save replaces the metadata for r.Name with the contents of r.
+	Save(r *Repo) error
+
+	// Delete removes the metadata for the named repo, and for any repos
+	// stored inside it (i.e. its snapshots).
+	Delete(name string) error
+}
+
+// metaStore is the MetadataStore used for all repos.
+var metaStore MetadataStore = jsonStore{}
+
+// openMetadataStore sets metaStore from the metadata setting in the config.
+func openMetadataStore() error {
+	kind, err := cfg.Get("metadata", "json")
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "json":
+		metaStore = jsonStore{}
+	case "bolt":
+		path, err := cfg.Get("path.metadata", "metadata.db")
+		if err != nil {
+			return err
+		}
+		metaStore, err = openBoltStore(path)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown metadata store '%s'", kind)
+	}
+	return nil
+}
+
+// jsonStore stores the metadata of each repo as a JSON document in the .meta
+// file in the repo directory.
+type jsonStore struct{}
+
+func metaPath(name string) string {
+	return filepath.Join(repoPath, name, ".meta")
+}
+
+func (jsonStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(metaPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		log.Printf("Failed to stat '%s': %s\n", metaPath(name), err)
+		return false, err
+	}
+	return true, nil
+}
+
+func (jsonStore) Load(r *Repo) error {
+	path := metaPath(r.Name)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open '%s' file: %s\n", path, err)
+		return err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(r)
+	if err != nil {
+		log.Printf("Failed to read '%s' file: %s\n", path, err)
+		return err
+	}
+	return nil
+}
+
+func (jsonStore) Save(r *Repo) error {
+	path := metaPath(r.Name)
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(r)
+	})
+	if err != nil {
+		log.Printf("Failed to write '%s' file: %s\n", path, err)
+		return err
+	}
+	return nil
+}
+
+// Delete removes the .meta file.  The file is normally removed along with
+// the rest of the repo directory, in which case there is nothing to do.
+func (jsonStore) Delete(name string) error {
+	err := os.Remove(metaPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove '%s': %s\n", metaPath(name), err)
+		return err
+	}
+	return nil
+}
+
+// migrateMetadata copies the metadata of every repo (and snapshot) that has a
+// .meta file into the given store.  The .meta files are left in place.  It
+// returns the names of the repos that were migrated.
+func migrateMetadata(to MetadataStore) ([]string, error) {
+	var migrated []string
+	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != ".meta" {
+			return nil
+		}
+		name, err := filepath.Rel(repoPath, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		// Snapshots that are still being written (or deleted) are skipped.
+		if filepath.Base(name)[0] == '.' {
+			return nil
+		}
+		r := newRepo(name)
+		err = r.load(jsonStore{})
+		if err != nil {
+			return err
+		}
+		err = to.Save(r)
+		if err != nil {
+			return err
+		}
+		migrated = append(migrated, name)
+		return nil
+	})
+	return migrated, err
+}
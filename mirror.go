@@ -0,0 +1,383 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qur/godebiancontrol"
+
+	"repo_server/deb"
+	"repo_server/opgp"
+)
+
+// MirrorConfig describes an upstream apt repository that packages are copied
+// from.  Only the given components of the upstream Dist are mirrored, into
+// the default codename of the repo and the components of the same name.
+// Packages, Priorities and Sections are optional filters, if any are set then
+// a package must match one entry of each to be mirrored.  Packages may contain
+// glob patterns.
+type MirrorConfig struct {
+	URL        string   `json:"url"`
+	Dist       string   `json:"dist"`
+	Components []string `json:"components"`
+	Keyring    string   `json:"keyring"`
+	Packages   []string `json:"packages,omitempty"`
+	Priorities []string `json:"priorities,omitempty"`
+	Sections   []string `json:"sections,omitempty"`
+}
+
+// MirroredPackage identifies a package version that was fetched from the
+// upstream repository.
+type MirroredPackage struct {
+	Component string `json:"component"`
+	Arch      string `json:"arch"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+// checkMirrorConfig makes sure that the mirror settings are valid.  It must be
+// called after checkComponentConfig.
+func (c *RepoConfig) checkMirrorConfig() error {
+	m := c.Mirror
+	if m == nil {
+		return nil
+	}
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("mirror url must be http or https")
+	}
+	if m.Dist == "" {
+		return fmt.Errorf("no mirror dist given")
+	}
+	if m.Keyring == "" {
+		return fmt.Errorf("no mirror keyring given")
+	}
+	for _, component := range m.Components {
+		if !contains(c.Components, component) {
+			return fmt.Errorf("mirrored component '%s' not in components", component)
+		}
+	}
+	for _, pattern := range m.Packages {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid mirror package pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// updateMirrorConfig applies the mirror settings to a RepoConfig.  The repo
+// is only a mirror if mirror-url is set.
+func updateMirrorConfig(c *RepoConfig, settings map[string]string) error {
+	val, ok := settings["mirror-url"]
+	if !ok || val == "" {
+		c.Mirror = nil
+		return nil
+	}
+	m := &MirrorConfig{
+		URL:        val,
+		Dist:       c.Codename,
+		Components: c.Components,
+	}
+	val, ok = settings["mirror-dist"]
+	if ok {
+		m.Dist = val
+	}
+	val, ok = settings["mirror-components"]
+	if ok {
+		m.Components = splitList(val)
+	}
+	m.Keyring = settings["mirror-keyring"]
+	m.Packages = splitList(settings["mirror-packages"])
+	m.Priorities = splitList(settings["mirror-priorities"])
+	m.Sections = splitList(settings["mirror-sections"])
+	c.Mirror = m
+	return c.checkMirrorConfig()
+}
+
+// wanted returns true if the package passes the mirror filters.
+func (m *MirrorConfig) wanted(para map[string]string) bool {
+	if len(m.Packages) > 0 {
+		match := false
+		for _, pattern := range m.Packages {
+			if ok, _ := path.Match(pattern, para["Package"]); ok {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(m.Priorities) > 0 && !contains(m.Priorities, para["Priority"]) {
+		return false
+	}
+	if len(m.Sections) > 0 {
+		// Sections outside main are given as e.g. contrib/net, which
+		// matches either contrib/net or net.
+		section := para["Section"]
+		if !contains(m.Sections, section) && !contains(m.Sections, path.Base(section)) {
+			return false
+		}
+	}
+	return true
+}
+
+// mirrorClient is used for all requests to upstream repositories.  Mirror
+// holds the repo lock while it runs, so a stalled upstream mustn't be able to
+// block the repo forever.  The timeout covers reading the whole response, so
+// it has to allow for large debs.
+var mirrorClient = &http.Client{Timeout: 10 * time.Minute}
+
+// fetch downloads the given URL into memory.
+func fetch(u string) ([]byte, error) {
+	resp, err := mirrorClient.Get(u)
+	if err != nil {
+		log.Printf("Failed to fetch '%s': %s\n", u, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to fetch '%s': %s\n", u, resp.Status)
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// download fetches the given URL into the file at dest, checking that it has
+// the expected size and SHA256.
+func download(u, dest string, size uint64, sum string) (*HashWriter, error) {
+	resp, err := mirrorClient.Get(u)
+	if err != nil {
+		log.Printf("Failed to fetch '%s': %s\n", u, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to fetch '%s': %s\n", u, resp.Status)
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		log.Printf("Failed to create '%s': %s\n", dest, err)
+		return nil, err
+	}
+	defer f.Close()
+	hw := NewHashWriter(f)
+	// Don't read more than we expect, a bad mirror shouldn't be able to
+	// fill the disk.
+	_, err = io.Copy(hw, io.LimitReader(resp.Body, int64(size)+1))
+	if err != nil {
+		log.Printf("Failed to fetch '%s': %s\n", u, err)
+		return nil, err
+	}
+	if uint64(hw.Written()) != size || hw.Sha256() != sum {
+		log.Printf("Fetched '%s' doesn't match the index\n", u)
+		return nil, fmt.Errorf("%s: size or hash mismatch", u)
+	}
+	return hw, nil
+}
+
+// releaseFiles parses the SHA256 field of an upstream Release file, returning
+// the hash and size of each file keyed by path.
+func releaseFiles(release []byte) (map[string]RepoFile, error) {
+	paras, err := godebiancontrol.Parse(bytes.NewReader(release))
+	if err != nil {
+		return nil, err
+	}
+	if len(paras) != 1 {
+		return nil, fmt.Errorf("expected 1 paragraph in Release, not %d", len(paras))
+	}
+	files := make(map[string]RepoFile)
+	for _, line := range strings.Split(paras[0]["SHA256"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid Release file line: '%s'", strings.TrimSpace(line))
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for '%s' in Release", fields[2])
+		}
+		files[fields[2]] = RepoFile{Size: size, Sha256: fields[0]}
+	}
+	return files, nil
+}
+
+// readIndex downloads the Packages index for the given component and arch,
+// using whichever compressed version upstream has that we can read.  It
+// returns nil if the index isn't available.
+func (m *MirrorConfig) readIndex(dir string, files map[string]RepoFile, component, arch string) ([]godebiancontrol.Paragraph, error) {
+	base := fmt.Sprintf("%s/binary-%s/Packages", component, arch)
+	for _, ext := range []string{".xz", ".gz", ""} {
+		file, ok := files[base+ext]
+		if !ok {
+			continue
+		}
+		u := fmt.Sprintf("%s/dists/%s/%s", strings.TrimSuffix(m.URL, "/"), m.Dist, base+ext)
+		dest := filepath.Join(dir, "Packages"+ext)
+		_, err := download(u, dest, file.Size, file.Sha256)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(dest)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r, err := deb.Decompress(ext, f)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return godebiancontrol.Parse(r)
+	}
+	log.Printf("No Packages index for %s/%s in upstream Release\n", component, arch)
+	return nil, nil
+}
+
+// Mirror updates the repo from its upstream repository, fetching any packages
+// that match the filters and that the repo doesn't have yet.  Packages that
+// are removed upstream are left alone, the retention policy can be used to
+// remove old versions.  The Release file of the last update is remembered,
+// and if it hasn't changed then nothing else is fetched - in which case
+// changed is false.
+func (r *Repo) Mirror() (fetched []MirroredPackage, changed bool, err error) {
+	m := r.Config.Mirror
+	if m == nil {
+		return nil, false, fmt.Errorf("%s is not a mirror", r.Name)
+	}
+	fetched = []MirroredPackage{}
+	base := strings.TrimSuffix(m.URL, "/")
+	inRelease, err := fetch(fmt.Sprintf("%s/dists/%s/InRelease", base, m.Dist))
+	if err != nil {
+		return nil, false, err
+	}
+	sum := sha256.Sum256(inRelease)
+	upstream := hex.EncodeToString(sum[:])
+	codename := r.Config.Codename
+	d := r.dist(codename)
+	if d.Upstream == upstream {
+		return fetched, false, nil
+	}
+	release, err := opgp.VerifyClearsigned(inRelease, m.Keyring)
+	if err != nil {
+		log.Printf("Failed to verify InRelease from '%s': %s\n", base, err)
+		return nil, false, err
+	}
+	files, err := releaseFiles(release)
+	if err != nil {
+		log.Printf("Failed to parse InRelease from '%s': %s\n", base, err)
+		return nil, false, err
+	}
+
+	dir, err := ioutil.TempDir(tmpPath, r.Name+"-")
+	if err != nil {
+		log.Printf("Failed to create tmp directory: %s\n", err)
+		return nil, false, err
+	}
+	defer os.RemoveAll(dir)
+
+	fetched, err = r.fetchPackages(dir, files)
+	if err == nil {
+		// The Release file is only remembered once everything in it has
+		// been fetched, so that a failed update is tried again.
+		d.Upstream = upstream
+	} else if len(fetched) == 0 {
+		return nil, false, err
+	}
+	// Packages fetched before a failure are already in the pool, so they
+	// are still saved.
+	_, removed := r.prune()
+	saveErr := r.saveAndRemove(removed)
+	if err == nil {
+		err = saveErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return fetched, true, nil
+}
+
+// fetchPackages adds the packages listed in the upstream indices that match
+// the filters and that the repo doesn't have yet, without saving the repo.
+// files holds the hashes from the upstream Release file, and dir is used for
+// the downloads.  If there is an error then the packages fetched so far are
+// returned along with it.
+func (r *Repo) fetchPackages(dir string, files map[string]RepoFile) ([]MirroredPackage, error) {
+	m := r.Config.Mirror
+	base := strings.TrimSuffix(m.URL, "/")
+	codename := r.Config.Codename
+	fetched := []MirroredPackage{}
+	seen := make(map[string]bool)
+	for _, component := range m.Components {
+		for _, arch := range r.Config.Architectures {
+			paras, err := m.readIndex(dir, files, component, arch)
+			if err != nil {
+				log.Printf("Failed to read Packages for %s/%s from '%s': %s\n", component, arch, base, err)
+				return fetched, err
+			}
+			for _, para := range paras {
+				name, version, filename := para["Package"], para["Version"], para["Filename"]
+				if !m.wanted(para) || seen[filename] {
+					continue
+				}
+				seen[filename] = true
+				if _, found := r.find(codename, component, arch, name, version); found {
+					continue
+				}
+				if !strings.HasPrefix(filename, "pool/") || strings.Contains(filename, "..") {
+					log.Printf("Ignoring upstream package with bad filename: %s\n", filename)
+					continue
+				}
+				size, err := strconv.ParseUint(para["Size"], 10, 64)
+				if err != nil {
+					log.Printf("Ignoring upstream package with bad size: %s\n", filename)
+					continue
+				}
+				if para["SHA256"] == "" {
+					// Without a SHA256 the download can't be checked.
+					log.Printf("Ignoring upstream package with no SHA256: %s\n", filename)
+					continue
+				}
+				debPath := filepath.Join(dir, path.Base(filename))
+				hw, err := download(base+"/"+filename, debPath, size, para["SHA256"])
+				if err == nil {
+					_, err = r.addDeb(debPath, hw, codename, component)
+				}
+				if err != nil {
+					return fetched, err
+				}
+				fetched = append(fetched, MirroredPackage{
+					Component: component,
+					Arch:      para["Architecture"],
+					Name:      name,
+					Version:   version,
+				})
+			}
+		}
+	}
+	return fetched, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"repo_server/opgp"
+)
+
+// The upstream repository in testdata/mirror is signed by the key in
+// keyring.asc.  It has three dists:
+//
+//   stable:   hello, and plain which only has an MD5sum
+//   broken:   hello, and missing whose deb isn't in the pool
+//   tampered: hello, but the InRelease text was changed after signing
+
+// newMirror creates a repo that mirrors the given dist from the upstream
+// repository at url.
+func newMirror(t *testing.T, url, dist string) *Repo {
+	r := newRepo("mirror")
+	r.Config.Architectures = []string{"amd64"}
+	err := updateMirrorConfig(&r.Config, map[string]string{
+		"mirror-url":     url,
+		"mirror-dist":    dist,
+		"mirror-keyring": "testdata/mirror/keyring.asc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func upstreamServer() *httptest.Server {
+	return httptest.NewServer(http.FileServer(http.Dir("testdata/mirror")))
+}
+
+func TestMirror(t *testing.T) {
+	setupTestDirs(t)
+	srv := upstreamServer()
+	defer srv.Close()
+	r := newMirror(t, srv.URL, "stable")
+
+	fetched, changed, err := r.Mirror()
+	if err != nil {
+		t.Fatalf("Mirror failed: %s", err)
+	}
+	if !changed {
+		t.Errorf("first Mirror reported no change")
+	}
+	// plain has no SHA256, so it is skipped.
+	want := MirroredPackage{Component: "main", Arch: "amd64", Name: "hello", Version: "1.0-1"}
+	if len(fetched) != 1 || fetched[0] != want {
+		t.Errorf("got fetched %+v, want [%+v]", fetched, want)
+	}
+	r, err = LoadRepo("mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, found := r.find(r.Config.Codename, "main", "amd64", "hello", "1.0-1")
+	if !found {
+		t.Fatalf("hello not in repo after Mirror")
+	}
+	_, err = os.Stat(filepath.Join(repoPath, "mirror", pkg.Filename))
+	if err != nil {
+		t.Errorf("hello not in pool: %s", err)
+	}
+
+	fetched, changed, err = r.Mirror()
+	if err != nil {
+		t.Fatalf("second Mirror failed: %s", err)
+	}
+	if changed || len(fetched) != 0 {
+		t.Errorf("second Mirror: got changed %v, fetched %+v", changed, fetched)
+	}
+}
+
+func TestMirrorFailureSavesFetched(t *testing.T) {
+	setupTestDirs(t)
+	srv := upstreamServer()
+	defer srv.Close()
+	r := newMirror(t, srv.URL, "broken")
+
+	_, _, err := r.Mirror()
+	if err == nil {
+		t.Fatalf("Mirror of broken dist succeeded")
+	}
+	r, err = LoadRepo("mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := r.find(r.Config.Codename, "main", "amd64", "hello", "1.0-1"); !found {
+		t.Errorf("hello fetched before the failure wasn't saved")
+	}
+	if upstream := r.dist(r.Config.Codename).Upstream; upstream != "" {
+		t.Errorf("upstream Release remembered after failure: %s", upstream)
+	}
+}
+
+func TestMirrorBadSignature(t *testing.T) {
+	setupTestDirs(t)
+	srv := upstreamServer()
+	defer srv.Close()
+	r := newMirror(t, srv.URL, "tampered")
+
+	_, _, err := r.Mirror()
+	if _, ok := err.(*opgp.BadSignature); !ok {
+		t.Fatalf("got error %v, want *opgp.BadSignature", err)
+	}
+	if len(r.ListPackages()[r.Config.Codename]["main"]) != 0 {
+		t.Errorf("packages added from tampered upstream")
+	}
+}
+
+func TestMirrorStalledUpstream(t *testing.T) {
+	setupTestDirs(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+	old := mirrorClient
+	mirrorClient = &http.Client{Timeout: 100 * time.Millisecond}
+	defer func() { mirrorClient = old }()
+	r := newMirror(t, srv.URL, "stable")
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := r.Mirror()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Mirror of a stalled upstream succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Mirror of a stalled upstream didn't time out")
+	}
+}
@@ -5,8 +5,10 @@
 package opgp
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
@@ -44,6 +46,14 @@ func (ni *NoIdentities) Error() string {
 	return fmt.Sprintf("Key '%s' has no identities", ni.Key)
 }
 
+type BadSignature struct {
+	Err error
+}
+
+func (bs *BadSignature) Error() string {
+	return fmt.Sprintf("Signature verification failed: %s", bs.Err)
+}
+
 func findKey(key string) (*openpgp.Entity, error) {
 	keyId, err := strconv.ParseUint(key, 16, 64)
 	if err != nil {
@@ -181,3 +191,35 @@ func ClearsignFile(filename, output, key string) error {
 
 	return Clearsign(in, out, key)
 }
+
+// readKeyring reads a public keyring file, which may be armored or binary.
+func readKeyring(filename string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	return el, err
+}
+
+// VerifyClearsigned checks that data is clearsigned by one of the keys in the
+// given keyring file, and returns the signed text.
+func VerifyClearsigned(data []byte, keyringFile string) ([]byte, error) {
+	keyring, err := readKeyring(keyringFile)
+	if err != nil {
+		log.Printf("Failed to read keyring '%s': %s\n", keyringFile, err)
+		return nil, err
+	}
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		return nil, &BadSignature{fmt.Errorf("no clearsigned message found")}
+	}
+	_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, &BadSignature{err}
+	}
+	return block.Plaintext, nil
+}
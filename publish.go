@@ -0,0 +1,190 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Each dist is published as dists/<codename>, which is a symlink to a
+// directory named .<codename>.<random> next to it.  When the repo is saved,
+// the new indices are written to a new directory which is then swapped in by
+// replacing the symlink, so clients always see a complete, consistent set of
+// index files.
+
+// distsPath returns the path of the dists directory of the repo.
+func (r *Repo) distsPath() string {
+	return filepath.Join(repoPath, r.Name, "dists")
+}
+
+// distPath returns the path of the directory that the files for the given
+// dist should be written to.  While the dist is being written this is the
+// staging directory, otherwise it is the published path.
+func (r *Repo) distPath(codename string) string {
+	if dir, ok := r.staging[codename]; ok {
+		return dir
+	}
+	return filepath.Join(r.distsPath(), codename)
+}
+
+// stageDist creates a new staging directory for the given dist.  If by-hash
+// is enabled then the existing by-hash files are linked into it, so that the
+// older generations remain available.
+func (r *Repo) stageDist(codename string) (string, error) {
+	base := r.distsPath()
+	err := os.MkdirAll(base, 0755)
+	if err != nil {
+		log.Printf("Failed to create directory '%s': %s\n", base, err)
+		return "", err
+	}
+	dir, err := ioutil.TempDir(base, "."+codename+".")
+	if err != nil {
+		log.Printf("Failed to create staging directory for '%s': %s\n", codename, err)
+		return "", err
+	}
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		log.Printf("Failed to chmod '%s': %s\n", dir, err)
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if r.Config.ByHash {
+		err = linkByHash(filepath.Join(base, codename), dir)
+		if err != nil {
+			log.Printf("Failed to copy by-hash files for '%s': %s\n", codename, err)
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// linkByHash hard links all the by-hash files from the published dist at src
+// into the staging directory dest, falling back to copying if linking fails.
+func linkByHash(src, dest string) error {
+	_, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	// Walk doesn't follow a symlink passed as the root, so make sure that we
+	// are walking the real directory.
+	src, err = filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.Contains(rel, "by-hash"+string(filepath.Separator)) {
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		if os.Link(path, target) == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+// publishDist atomically replaces the published dist with the given staging
+// directory, and then removes the old directory (and any left behind by
+// earlier failures).
+func (r *Repo) publishDist(codename, dir string) error {
+	base := r.distsPath()
+	live := filepath.Join(base, codename)
+	info, err := os.Lstat(live)
+	if err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// A dist published before staging was used is a real directory,
+		// which can't be atomically replaced by a symlink - so move it out
+		// of the way first.  This only happens once.
+		err = os.Rename(live, filepath.Join(base, "."+codename+".old"))
+		if err != nil {
+			log.Printf("Failed to move old dist '%s': %s\n", live, err)
+			return err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to stat '%s': %s\n", live, err)
+		return err
+	}
+	link := filepath.Join(base, "."+codename+".link")
+	err = os.Remove(link)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove '%s': %s\n", link, err)
+		return err
+	}
+	err = os.Symlink(filepath.Base(dir), link)
+	if err != nil {
+		log.Printf("Failed to create symlink '%s': %s\n", link, err)
+		return err
+	}
+	err = os.Rename(link, live)
+	if err != nil {
+		log.Printf("Failed to publish '%s': %s\n", live, err)
+		return err
+	}
+	files, err := ioutil.ReadDir(base)
+	if err != nil {
+		log.Printf("Failed to ReadDir(%s): %s\n", base, err)
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(base, file.Name())
+		if path == dir || !isDistDir(codename, file.Name()) {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			log.Printf("Failed to remove old dist '%s': %s\n", path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// isDistDir returns true if name is one of the files used to publish the
+// given dist: a .<codename>.<random> directory, the .<codename>.old directory
+// of a dist published before staging was used, or a .<codename>.link left by
+// an interrupted publish.  Other dists can have names that start the same way
+// (e.g. "1" and "1.2"), so the suffix must be checked.
+func isDistDir(codename, name string) bool {
+	suffix := strings.TrimPrefix(name, "."+codename+".")
+	if suffix == name || suffix == "" {
+		return false
+	}
+	return suffix == "old" || suffix == "link" || strings.Trim(suffix, "0123456789") == ""
+}
+
+// writeDist writes all the index files for the given dist into a staging
+// directory, and then publishes them.
+func (r *Repo) writeDist(codename string) error {
+	dir, err := r.stageDist(codename)
+	if err != nil {
+		return err
+	}
+	if r.staging == nil {
+		r.staging = make(map[string]string)
+	}
+	r.staging[codename] = dir
+	err = r.writeIndices(codename)
+	delete(r.staging, codename)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return r.publishDist(codename, dir)
+}
@@ -0,0 +1,210 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const releaseDateFormat = "Mon, 02 Jan 2006 15:04:05 MST"
+
+// refreshInterval is how often refreshReleases checks for Release files that
+// are due to expire.  valid-for must be at least four times this, so that the
+// Release files are always rewritten before they expire.
+const refreshInterval = 15 * time.Minute
+
+// parseSuites parses a list of codename=suite pairs.
+func parseSuites(s string) (map[string]string, error) {
+	suites := make(map[string]string)
+	for _, pair := range splitList(s) {
+		bits := strings.SplitN(pair, "=", 2)
+		if len(bits) != 2 || bits[0] == "" || bits[1] == "" {
+			return nil, fmt.Errorf("invalid suite '%s', should be codename=suite", pair)
+		}
+		suites[bits[0]] = bits[1]
+	}
+	return suites, nil
+}
+
+// checkReleaseConfig makes sure that the settings used to fill in the Release
+// files are valid.  It must be called after checkDistConfig.
+func (c *RepoConfig) checkReleaseConfig() error {
+	seen := make(map[string]string, len(c.Suites))
+	for codename, suite := range c.Suites {
+		if !contains(c.Codenames, codename) {
+			return fmt.Errorf("suite given for unknown codename '%s'", codename)
+		}
+		err := checkNames("suite", []string{suite})
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[suite]; ok {
+			return fmt.Errorf("suite '%s' used for both '%s' and '%s'", suite, other, codename)
+		}
+		seen[suite] = codename
+	}
+	validFor, err := parsePeriod(c.ValidFor)
+	if err != nil {
+		return err
+	}
+	if validFor > 0 && validFor < 4*refreshInterval {
+		return fmt.Errorf("valid-for must be at least %s", 4*refreshInterval)
+	}
+	if c.ButAutomaticUpgrades && !c.NotAutomatic {
+		return fmt.Errorf("but_automatic_upgrades requires not_automatic")
+	}
+	return nil
+}
+
+// updateReleaseConfig applies the Release file settings to a RepoConfig.
+func updateReleaseConfig(c *RepoConfig, settings map[string]string) error {
+	var err error
+	val, ok := settings["suites"]
+	if ok {
+		c.Suites, err = parseSuites(val)
+		if err != nil {
+			return err
+		}
+	}
+	val, ok = settings["suite"]
+	if ok {
+		if c.Suites == nil {
+			c.Suites = make(map[string]string)
+		}
+		c.Suites[c.Codename] = val
+	}
+	val, ok = settings["version"]
+	if ok {
+		c.Version = val
+	}
+	val, ok = settings["valid-for"]
+	if ok {
+		c.ValidFor = val
+	}
+	val, ok = settings["not-automatic"]
+	if ok {
+		c.NotAutomatic, err = strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+	}
+	val, ok = settings["but-automatic-upgrades"]
+	if ok {
+		c.ButAutomaticUpgrades, err = strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+	}
+	val, ok = settings["changelogs"]
+	if ok {
+		c.Changelogs = val
+	}
+	val, ok = settings["signed-by"]
+	if ok {
+		c.SignedBy = strings.Join(splitList(val), ", ")
+	}
+	return c.checkReleaseConfig()
+}
+
+// releaseHeader returns the fields that start the top level Release file for
+// the given codename.
+func (r *Repo) releaseHeader(codename string) string {
+	now := time.Now().UTC()
+	s := fmt.Sprintf("Origin: %s\n", r.Config.Origin)
+	s += fmt.Sprintf("Label: %s\n", r.Config.Label)
+	if suite, ok := r.Config.Suites[codename]; ok {
+		s += fmt.Sprintf("Suite: %s\n", suite)
+	}
+	if r.Config.Version != "" {
+		s += fmt.Sprintf("Version: %s\n", r.Config.Version)
+	}
+	s += fmt.Sprintf("Codename: %s\n", codename)
+	if r.Config.Changelogs != "" {
+		s += fmt.Sprintf("Changelogs: %s\n", r.Config.Changelogs)
+	}
+	s += fmt.Sprintf("Date: %s\n", now.Format(releaseDateFormat))
+	// The config has already been checked, so the error can be ignored.
+	validFor, _ := parsePeriod(r.Config.ValidFor)
+	if validFor > 0 {
+		s += fmt.Sprintf("Valid-Until: %s\n", now.Add(validFor).Format(releaseDateFormat))
+	}
+	if r.Config.NotAutomatic {
+		s += "NotAutomatic: yes\n"
+		if r.Config.ButAutomaticUpgrades {
+			s += "ButAutomaticUpgrades: yes\n"
+		}
+	}
+	if r.Config.ByHash {
+		s += "Acquire-By-Hash: yes\n"
+	}
+	if r.Config.SignedBy != "" {
+		s += fmt.Sprintf("Signed-By: %s\n", r.Config.SignedBy)
+	}
+	s += fmt.Sprintf("Architectures: %s\n", strings.Join(r.Config.Architectures, " "))
+	s += fmt.Sprintf("Components: %s\n", strings.Join(r.Config.Components, " "))
+	s += fmt.Sprintf("Description: %s\n", r.Config.Description)
+	return s
+}
+
+// refreshReleases runs forever, re-saving any repo with a valid-for setting
+// once half of the period has passed since its Release files were written.
+// This keeps Valid-Until in the future (and the files signed) for repos that
+// aren't being changed.
+func refreshReleases() {
+	for range time.Tick(refreshInterval) {
+		files, err := ioutil.ReadDir(repoPath)
+		if err != nil {
+			log.Printf("Failed to ReadDir(%s): %s\n", repoPath, err)
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				refreshRelease(file.Name())
+			}
+		}
+	}
+}
+
+// refreshRelease re-saves the named repo if its Release files need to be
+// rewritten.
+func refreshRelease(name string) {
+	unlock, err := lockRepo(name)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	repo, err := LoadRepo(name)
+	if err != nil {
+		return
+	}
+	if !repo.releaseExpiring(time.Now()) {
+		return
+	}
+	log.Printf("Refreshing Release files of '%s'\n", name)
+	repo.Save()
+}
+
+// releaseExpiring returns true if the repo has a valid-for setting, and half of
+// the period has passed since any of its Release files were written.
+func (r *Repo) releaseExpiring(now time.Time) bool {
+	validFor, _ := parsePeriod(r.Config.ValidFor)
+	if validFor <= 0 {
+		return false
+	}
+	for _, codename := range r.Config.Codenames {
+		info, err := os.Stat(filepath.Join(r.distPath(codename), "Release"))
+		if err != nil || now.Sub(info.ModTime()) > validFor/2 {
+			return true
+		}
+	}
+	return false
+}
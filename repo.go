@@ -5,13 +5,12 @@
 package main
 
 import (
-	"compress/gzip"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,21 +20,80 @@ import (
 )
 
 type Repo struct {
-	Name     string              `json:"-"`
-	Config   RepoConfig          `json:"config"`
-	Packages RepoPackages        `json:"packages"`
-	Files    map[string]RepoFile `json:"files"`
+	Name   string           `json:"-"`
+	Config RepoConfig       `json:"config"`
+	Dists  map[string]*Dist `json:"dists"`
+
+	// Contents maps the pool paths of debs to the files that they install,
+	// for the Contents indices.  The lists are kept here rather than in the
+	// packages, so that each is stored once however many dists and arches
+	// use the deb.
+	Contents map[string][]string `json:"contents,omitempty"`
+
+	// These are only used to load .meta files written before multiple
+	// components and dists were supported, Load moves the contents into
+	// Dists.
+	Components map[string]RepoPackages `json:"components,omitempty"`
+	Packages   RepoPackages            `json:"packages,omitempty"`
+	Files      map[string]RepoFile     `json:"files,omitempty"`
+
+	// staging maps codenames to the directories that the dists are being
+	// written to during Save.
+	staging map[string]string
+}
+
+// Dist holds the packages published in one distribution (codename) of a repo.
+// All the dists in a repo share the same pool.
+type Dist struct {
+	Components map[string]RepoPackages `json:"components"`
+	Files      map[string]RepoFile     `json:"files"`
+
+	// ByHash records the recent generations of each index file (most recent
+	// first), which are available from the by-hash directories.
+	ByHash map[string][]RepoFile `json:"by_hash,omitempty"`
+
+	// Upstream is the SHA256 of the InRelease file that the dist was last
+	// mirrored from, if the repo is a mirror.
+	Upstream string `json:"upstream,omitempty"`
 }
 
 type RepoConfig struct {
-	Origin      string `json:"origin"`
-	Label       string `json:"label"`
-	Description string `json:"description"`
-	Codename    string `json:"codename"`
-	Component   string `json:"component"`
-	Sign        bool   `json:"sign"`
-	SignDebs    bool   `json:"sign_debs"`
-	GpgKey      string `json:"gpgkey"`
+	Origin        string   `json:"origin"`
+	Label         string   `json:"label"`
+	Description   string   `json:"description"`
+	Codename      string   `json:"codename"`
+	Codenames     []string `json:"codenames"`
+	Component     string   `json:"component"`
+	Components    []string `json:"components"`
+	Architectures []string `json:"architectures"`
+	Compressions  []string `json:"compressions"`
+	ByHash        bool     `json:"by_hash"`
+	ByHashHashes  []string `json:"by_hash_hashes"`
+	ByHashKeep    int      `json:"by_hash_keep"`
+	Translations  bool     `json:"translations"`
+	Sign          bool     `json:"sign"`
+	SignDebs      bool     `json:"sign_debs"`
+	GpgKey        string   `json:"gpgkey"`
+
+	// The retention policy.  If either is set then old versions of a
+	// package are removed when a new one is added, keeping the newest
+	// KeepVersions versions and any added less than KeepFor ago.
+	KeepVersions int    `json:"keep_versions"`
+	KeepFor      string `json:"keep_for,omitempty"`
+
+	// These settings are only used to fill in the Release files.  Suites
+	// maps codenames to suite names (e.g. stable), and ValidFor is how long
+	// a Release file is valid for after it has been written.
+	Suites               map[string]string `json:"suites,omitempty"`
+	Version              string            `json:"version,omitempty"`
+	ValidFor             string            `json:"valid_for,omitempty"`
+	NotAutomatic         bool              `json:"not_automatic"`
+	ButAutomaticUpgrades bool              `json:"but_automatic_upgrades"`
+	Changelogs           string            `json:"changelogs,omitempty"`
+	SignedBy             string            `json:"signed_by,omitempty"`
+
+	// Mirror is set if packages are fetched from an upstream repository.
+	Mirror *MirrorConfig `json:"mirror,omitempty"`
 }
 
 type RepoFile struct {
@@ -45,16 +103,19 @@ type RepoFile struct {
 	Md5    string `json:"md5"`
 }
 
-type RepoPackages struct {
-	I386   PackageGroup `json:"i386"`
-	Amd64  PackageGroup `json:"amd64"`
-	Source PackageGroup `json:"source"`
-}
+// RepoPackages holds the PackageGroup for each architecture, keyed by the
+// architecture name.  Source packages are stored under "source".
+type RepoPackages map[string]PackageGroup
 
 type PackageGroup map[string]PackageSet
 
 type PackageSet map[string]Package
 
+// Package is a single version of a package.  For source packages Filename and
+// the hashes refer to the .dsc file, while Directory and Files list all of the
+// files that make up the source package (including the .dsc).  Contents is
+// only used to load metadata written when file lists were stored in each
+// package, Load moves the lists into Repo.Contents.
 type Package struct {
 	Control     map[string]string `json:"control"`
 	Description string            `json:"description"`
@@ -63,29 +124,164 @@ type Package struct {
 	Sha1        string            `json:"sha1"`
 	Sha256      string            `json:"sha256"`
 	Md5         string            `json:"md5"`
+	Directory   string            `json:"directory,omitempty"`
+	Files       []deb.SourceFile  `json:"files,omitempty"`
+	Contents    []string          `json:"contents,omitempty"`
+	Added       time.Time         `json:"added"`
 }
 
 type PackageDetails map[string]map[string][]string
 
+type ComponentDetails map[string]PackageDetails
+
+type DistDetails map[string]ComponentDetails
+
+var defaultArches = []string{"i386", "amd64"}
+
 func newRepo(name string) *Repo {
 	return &Repo{
 		Name: name,
 		Config: RepoConfig{
-			Origin:      "<origin>",
-			Label:       "<label>",
-			Description: "<description>",
-			Codename:    "<codename>",
-			Component:   "main",
-			Sign:        false,
-			SignDebs:    false,
-			GpgKey:      "",
-		},
-		Packages: RepoPackages{
-			I386:   make(PackageGroup),
-			Amd64:  make(PackageGroup),
-			Source: make(PackageGroup),
+			Origin:        "<origin>",
+			Label:         "<label>",
+			Description:   "<description>",
+			Codename:      "<codename>",
+			Codenames:     []string{"<codename>"},
+			Component:     "main",
+			Components:    []string{"main"},
+			Architectures: defaultArches,
+			Compressions:  defaultCompressions,
+			ByHash:        false,
+			ByHashHashes:  defaultByHashHashes,
+			ByHashKeep:    defaultByHashKeep,
+			Sign:          false,
+			SignDebs:      false,
+			GpgKey:        "",
 		},
-		Files: make(map[string]RepoFile),
+		Dists:    make(map[string]*Dist),
+		Contents: make(map[string][]string),
+	}
+}
+
+func newDist() *Dist {
+	return &Dist{
+		Components: make(map[string]RepoPackages),
+		Files:      make(map[string]RepoFile),
+		ByHash:     make(map[string][]RepoFile),
+	}
+}
+
+// checkArches validates a list of architectures for use in a RepoConfig.  The
+// pseudo architectures "all" and "source" are always handled by the repo, so
+// they may not be listed explicitly.
+func checkArches(arches []string) error {
+	if len(arches) == 0 {
+		return fmt.Errorf("no architectures given")
+	}
+	seen := make(map[string]bool, len(arches))
+	for _, arch := range arches {
+		switch {
+		case arch == "all" || arch == "source":
+			return fmt.Errorf("architecture '%s' may not be configured", arch)
+		case arch == "" || strings.ContainsAny(arch, " \t\n/_"):
+			return fmt.Errorf("invalid architecture: '%s'", arch)
+		case arch != strings.ToLower(arch):
+			return fmt.Errorf("architecture must be lower case: '%s'", arch)
+		case seen[arch]:
+			return fmt.Errorf("architecture listed twice: '%s'", arch)
+		}
+		seen[arch] = true
+	}
+	return nil
+}
+
+// checkNames validates a list of component or codename names for use in a
+// RepoConfig.  The names are used as paths under dists/ (and pool/ in the case
+// of components).
+func checkNames(what string, names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no %ss given", what)
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch {
+		case name == "" || strings.ContainsAny(name, " \t\n\x00") || strings.Contains(name, ".."):
+			return fmt.Errorf("invalid %s: '%s'", what, name)
+		case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"):
+			return fmt.Errorf("invalid %s: '%s'", what, name)
+		case seen[name]:
+			return fmt.Errorf("%s listed twice: '%s'", what, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// checkDefault makes sure that def is one of names, filling in def from the
+// first of names if it is not set.  If names is empty, then it is set to just
+// def.
+func checkDefault(what string, def *string, names *[]string) error {
+	if len(*names) == 0 && *def != "" {
+		*names = []string{*def}
+	}
+	err := checkNames(what, *names)
+	if err != nil {
+		return err
+	}
+	if *def == "" {
+		*def = (*names)[0]
+	}
+	for _, name := range *names {
+		if name == *def {
+			return nil
+		}
+	}
+	return fmt.Errorf("default %s '%s' not in %ss", what, *def, what)
+}
+
+// checkComponentConfig makes sure that the component settings of the config
+// are consistent, filling in the default component if it is not set.
+func (c *RepoConfig) checkComponentConfig() error {
+	return checkDefault("component", &c.Component, &c.Components)
+}
+
+// checkDistConfig makes sure that the codename settings of the config are
+// consistent, filling in the default codename if it is not set.
+func (c *RepoConfig) checkDistConfig() error {
+	err := checkDefault("codename", &c.Codename, &c.Codenames)
+	if err != nil {
+		return err
+	}
+	// Unlike components, the dists are published as single directories
+	// under dists/, so codenames can't contain a "/".
+	for _, codename := range c.Codenames {
+		if strings.Contains(codename, "/") {
+			return fmt.Errorf("invalid codename: '%s'", codename)
+		}
+	}
+	return nil
+}
+
+// updateList applies the settings for a default value (e.g. "component") and
+// the matching list (e.g. "components") to a RepoConfig.
+func updateList(settings map[string]string, defKey, listKey string, def *string, names *[]string) {
+	defVal, defOk := settings[defKey]
+	val, ok := settings[listKey]
+	if ok {
+		*names = splitList(val)
+		if defOk {
+			*def = defVal
+		} else if !contains(*names, *def) {
+			*def = ""
+		}
+	} else if defOk && !contains(*names, defVal) {
+		// Only the old single value setting is used.  The new value is
+		// added to the list rather than replacing it, so that any packages
+		// already published under the other values aren't dropped.
+		*names = append(*names, defVal)
+		*def = defVal
+	} else if defOk {
+		*def = defVal
 	}
 }
 
@@ -105,12 +301,29 @@ func LoadRepo(name string) (*Repo, error) {
 func UpdateSharedRepo(name string, settings map[string]string) error {
 	var repo *Repo
 	path := filepath.Join(repoPath, name)
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		repo = newRepo(name)
-	} else if err != nil {
-		log.Printf("Failed to stat '%s': %s\n", repoPath, err)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		log.Printf("Failed to create repo directory: %s\n", err)
+		return err
+	}
+	unlock, err := lockRepo(name)
+	if err != nil {
 		return err
+	}
+	defer unlock()
+	exists, err := metaStore.Exists(name)
+	if err != nil {
+		return err
+	} else if !exists {
+		// Don't quietly start again from scratch if the repo just hasn't
+		// been migrated to the metadata store yet.
+		if _, ok := metaStore.(jsonStore); !ok {
+			legacy, _ := jsonStore{}.Exists(name)
+			if legacy {
+				return fmt.Errorf("repo %s has a .meta file, run with -migrate first", name)
+			}
+		}
+		repo = newRepo(name)
 	} else {
 		repo, err = LoadRepo(name)
 		if err != nil {
@@ -129,13 +342,77 @@ func UpdateSharedRepo(name string, settings map[string]string) error {
 	if ok {
 		repo.Config.Description = val
 	}
-	val, ok = settings["codename"]
+	updateList(settings, "codename", "codenames", &repo.Config.Codename, &repo.Config.Codenames)
+	err = repo.Config.checkDistConfig()
+	if err != nil {
+		return err
+	}
+	err = updateReleaseConfig(&repo.Config, settings)
+	if err != nil {
+		return err
+	}
+	err = updateRetentionConfig(&repo.Config, settings)
+	if err != nil {
+		return err
+	}
+	updateList(settings, "component", "components", &repo.Config.Component, &repo.Config.Components)
+	err = repo.Config.checkComponentConfig()
+	if err != nil {
+		return err
+	}
+	err = updateMirrorConfig(&repo.Config, settings)
+	if err != nil {
+		return err
+	}
+	val, ok = settings["architectures"]
+	if ok {
+		arches := splitList(val)
+		err = checkArches(arches)
+		if err != nil {
+			return err
+		}
+		repo.Config.Architectures = arches
+		repo.fanOutAll()
+	}
+	val, ok = settings["compressions"]
 	if ok {
-		repo.Config.Codename = val
+		names := splitList(val)
+		err = checkCompressions(names)
+		if err != nil {
+			return err
+		}
+		repo.Config.Compressions = names
 	}
-	val, ok = settings["component"]
+	val, ok = settings["by-hash"]
 	if ok {
-		repo.Config.Component = val
+		repo.Config.ByHash, err = strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+	}
+	val, ok = settings["translations"]
+	if ok {
+		repo.Config.Translations, err = strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+	}
+	val, ok = settings["by-hash-hashes"]
+	if ok {
+		names := splitList(val)
+		err = checkByHashHashes(names)
+		if err != nil {
+			return err
+		}
+		repo.Config.ByHashHashes = names
+	}
+	val, ok = settings["by-hash-keep"]
+	if ok {
+		keep, err := strconv.ParseUint(val, 10, 16)
+		if err != nil {
+			return err
+		}
+		repo.Config.ByHashKeep = int(keep)
 	}
 	val, ok = settings["sign"]
 	if ok {
@@ -166,22 +443,93 @@ func UpdateSharedRepo(name string, settings map[string]string) error {
 }
 
 func (r *Repo) Load() error {
-	path := filepath.Join(repoPath, r.Name)
-	metaPath := filepath.Join(path, ".meta")
-	f, err := os.Open(metaPath)
+	return r.load(metaStore)
+}
+
+func (r *Repo) load(store MetadataStore) error {
+	// Clear any list settings, so that we can tell if the stored metadata
+	// didn't have them.
+	r.Config.Codenames = nil
+	r.Config.Components = nil
+	r.Config.Architectures = nil
+	r.Config.Compressions = nil
+	r.Config.ByHashHashes = nil
+	err := store.Load(r)
 	if err != nil {
-		log.Printf("Failed to open '%s' file: %s\n", metaPath, err)
 		return err
 	}
-	defer f.Close()
-	err = json.NewDecoder(f).Decode(r)
-	if err != nil {
-		log.Printf("Failed to read '%s' file: %s\n", metaPath, err)
-		return err
+	// Older .meta files don't have an architecture list, or may have an
+	// explicit null - in which case they used the fixed default set.
+	if len(r.Config.Architectures) == 0 {
+		r.Config.Architectures = defaultArches
+	}
+	if len(r.Config.Compressions) == 0 {
+		r.Config.Compressions = defaultCompressions
+	}
+	if len(r.Config.ByHashHashes) == 0 {
+		r.Config.ByHashHashes = defaultByHashHashes
+	}
+	// Similarly, older files only had a single component and codename.
+	if len(r.Config.Components) == 0 {
+		r.Config.Components = []string{r.Config.Component}
+	}
+	if len(r.Config.Codenames) == 0 {
+		r.Config.Codenames = []string{r.Config.Codename}
+	}
+	if r.Dists == nil {
+		r.Dists = make(map[string]*Dist)
+	}
+	if len(r.Packages) > 0 {
+		r.dist(r.Config.Codename).Components[r.Config.Component] = r.Packages
+	}
+	for component, rp := range r.Components {
+		r.dist(r.Config.Codename).Components[component] = rp
+	}
+	r.Packages = nil
+	r.Components = nil
+	r.Files = nil
+	if r.Contents == nil {
+		r.Contents = make(map[string][]string)
+	}
+	for _, d := range r.Dists {
+		if d.Components == nil {
+			d.Components = make(map[string]RepoPackages)
+		}
+		for _, rp := range d.Components {
+			for _, pg := range rp {
+				for _, set := range pg {
+					for version, pkg := range set {
+						if pkg.Contents == nil {
+							continue
+						}
+						r.Contents[pkg.Filename] = pkg.Contents
+						pkg.Contents = nil
+						set[version] = pkg
+					}
+				}
+			}
+		}
+		if d.Files == nil {
+			d.Files = make(map[string]RepoFile)
+		}
+		if d.ByHash == nil {
+			d.ByHash = make(map[string][]RepoFile)
+		}
 	}
 	return nil
 }
 
+// dist returns the Dist for the given codename, creating it if it doesn't
+// exist yet.
+func (r *Repo) dist(codename string) *Dist {
+	d, found := r.Dists[codename]
+	if !found {
+		d = newDist()
+		r.Dists[codename] = d
+	}
+	return d
+}
+
 func (r *Repo) Save() error {
 	path := filepath.Join(repoPath, r.Name)
 	err := os.MkdirAll(path, 0755)
@@ -189,38 +537,81 @@ func (r *Repo) Save() error {
 		log.Printf("Failed to create repo directory: %s\n", err)
 		return err
 	}
-	metaPath := filepath.Join(path, ".meta")
-	f, err := os.Create(metaPath)
+	err = r.writeDists()
+	if err == nil {
+		err = r.uploadPool()
+	}
+	if err == nil {
+		err = r.uploadDists()
+	}
+	// The .meta file is written even if publishing failed, so that we don't
+	// lose track of any packages already in the pool.  It is written last so
+	// that it records the hashes of the files that were actually published.
+	metaErr := r.writeMeta()
 	if err != nil {
-		log.Printf("Failed to open '%s' file: %s\n", metaPath, err)
 		return err
 	}
-	defer f.Close()
-	err = json.NewEncoder(f).Encode(r)
+	return metaErr
+}
+
+func (r *Repo) writeMeta() error {
+	return metaStore.Save(r)
+}
+
+func (r *Repo) writeDists() error {
+	for _, codename := range r.Config.Codenames {
+		err := r.writeDist(codename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIndices writes all the index files for the given dist.
+func (r *Repo) writeIndices(codename string) error {
+	// The index files are all regenerated, so forget any old hashes - this
+	// stops files for architectures that have been dropped being listed.
+	r.dist(codename).Files = make(map[string]RepoFile)
+	err := r.writePackages(codename)
+	if err != nil {
+		return err
+	}
+	err = r.writeContents(codename)
 	if err != nil {
-		log.Printf("Failed to read '%s' file: %s\n", metaPath, err)
 		return err
 	}
-	err = r.writePackages()
+	err = r.writeTranslations(codename)
 	if err != nil {
 		return err
 	}
-	return r.writeRelease()
+	if !r.Config.ByHash {
+		err = r.removeByHash(codename)
+		if err != nil {
+			return err
+		}
+	}
+	return r.writeRelease(codename)
 }
 
-func (r *Repo) storeHashes(path string, hw *HashWriter) {
-	base := filepath.Join(repoPath, r.Name, "dists", r.Config.Codename)
+func (r *Repo) storeHashes(codename, path string, hw *HashWriter) error {
+	base := r.distPath(codename)
 	rel, err := filepath.Rel(base, path)
 	if err != nil || strings.HasPrefix(rel, "..") {
 		log.Printf("Path '%s' wasn't under '%s'", path, base)
-		return
+		return nil
 	}
-	r.Files[rel] = RepoFile{
+	file := RepoFile{
 		Size:   uint64(hw.Written()),
 		Sha1:   hw.Sha1(),
 		Sha256: hw.Sha256(),
 		Md5:    hw.Md5(),
 	}
+	r.dist(codename).Files[rel] = file
+	if !r.Config.ByHash {
+		return nil
+	}
+	return r.storeByHash(codename, rel, path, file)
 }
 
 func (r *Repo) signDeb(debPath string) error {
@@ -241,25 +632,41 @@ func (r *Repo) signDeb(debPath string) error {
 	return nil
 }
 
-func (r *Repo) parseDeb(debPath string) error {
+// unsignDeb removes any existing signature from the deb at debPath.
+func unsignDeb(debPath string) error {
+	d, err := deb.Open(debPath)
+	if err != nil {
+		log.Printf("Failed to open deb '%s': %s\n", debPath, err)
+		return err
+	}
+	defer d.Close()
+	err = d.Unsign()
+	if err != nil {
+		log.Printf("Failed to remove signature from deb '%s': %s\n", debPath, err)
+		return err
+	}
+	return nil
+}
+
+func (r *Repo) parseDeb(debPath string, hw *HashWriter, codename, component string) (pkgVersion, error) {
 	pkg := Package{}
 
 	d, err := deb.Open(debPath)
 	if err != nil {
 		log.Printf("Failed to open deb '%s': %s\n", debPath, err)
-		return err
+		return pkgVersion{}, err
 	}
 	defer d.Close()
 
 	info, err := d.Control("control")
 	if err != nil {
 		log.Printf("Failed to parse deb '%s': %s\n", debPath, err)
-		return err
+		return pkgVersion{}, err
 	}
 
 	if len(info) != 1 {
 		log.Printf("%s: Expected 1 paragraph in .deb control file, not %d\n", debPath, len(info))
-		return fmt.Errorf("%s/1 paragraphs in control: %s", len(info), debPath)
+		return pkgVersion{}, fmt.Errorf("%d/1 paragraphs in control: %s", len(info), debPath)
 	}
 
 	version := info[0]["Version"]
@@ -270,184 +677,510 @@ func (r *Repo) parseDeb(debPath string) error {
 	pkg.Control = info[0]
 	delete(pkg.Control, "Description")
 
+	files, err := d.Files()
+	if err != nil {
+		log.Printf("Failed to list files in deb '%s': %s\n", debPath, err)
+		return pkgVersion{}, err
+	}
+
 	if version == "" {
 		log.Printf("deb did not include version info: %s\n", debPath)
-		return fmt.Errorf("no version in %s", debPath)
+		return pkgVersion{}, fmt.Errorf("no version in %s", debPath)
+	}
+	_, err = deb.ParseVersion(version)
+	if err != nil {
+		log.Printf("deb has invalid version: %s: %s\n", debPath, err)
+		return pkgVersion{}, err
 	}
 	if pkgName == "" {
 		log.Printf("deb did not include package name: %s\n", debPath)
-		return fmt.Errorf("no package name in %s", debPath)
+		return pkgVersion{}, fmt.Errorf("no package name in %s", debPath)
 	}
 	if arch == "" {
 		log.Printf("deb did not include architecture: %s\n", debPath)
-		return fmt.Errorf("no architecture in %s", debPath)
+		return pkgVersion{}, fmt.Errorf("no architecture in %s", debPath)
 	}
-	base := fmt.Sprintf("pool/%s/%s/%s/", r.Config.Component, pkgName[0:1], pkgName)
-	debName := fmt.Sprintf("%s_%s_%s.deb", pkgName, version, arch)
-	pkg.Filename = filepath.Join(base, debName)
-	filename := filepath.Join(repoPath, r.Name, pkg.Filename)
-	f, err := os.Open(debPath)
+	arches, err := r.getArch(codename, component, arch)
 	if err != nil {
-		log.Printf("Failed to open '%s': %s\n", debPath, err)
-		return err
+		return pkgVersion{}, err
 	}
-	defer f.Close()
-	destDir := filepath.Dir(filename)
-	if destDir != "." {
-		err = os.MkdirAll(destDir, 0755)
+
+	base := fmt.Sprintf("pool/%s/%s/%s/", component, pkgName[0:1], pkgName)
+	debName := fmt.Sprintf("%s_%s_%s.deb", pkgName, version, arch)
+	pkg.Filename = filepath.Join(base, debName)
+	// All the dists share the pool, so if another dist already has this deb
+	// then the existing file is used - it mustn't be replaced by a
+	// different one, as that would break the dists that are using it.  If
+	// only the entries that are being replaced use it, then it is replaced
+	// along with them.
+	existing, found := r.usedBy(pkg.Filename)
+	if found {
+		same, err := r.sameDeb(d, debPath, hw, existing)
 		if err != nil {
-			log.Printf("Failed to create '%s': %s\n", destDir, err)
-			return err
+			return pkgVersion{}, err
 		}
+		replacing := []string{strings.ToLower(arch)}
+		if replacing[0] == "all" {
+			replacing = r.Config.Architectures
+		}
+		if !same && r.usedOutside(pkg.Filename, codename, component, replacing) {
+			log.Printf("'%s' already exists with different contents\n", pkg.Filename)
+			return pkgVersion{}, &PoolConflict{pkg.Filename}
+		}
+		found = same
 	}
-	w, err := os.Create(filename)
-	if err != nil {
-		log.Printf("Failed to open '%s': %s\n", filename, err)
-		return err
-	}
-	hw := NewHashWriter(w)
-	defer w.Close()
-	size, err := io.Copy(hw, f)
-	if err != nil {
-		log.Printf("Failed to copy '%s' -> '%s': %s\n", debPath, filename, err)
-		return err
+	if found {
+		pkg.Size = existing.Size
+		pkg.Sha1 = existing.Sha1
+		pkg.Sha256 = existing.Sha256
+		pkg.Md5 = existing.Md5
+	} else {
+		hw, err = r.moveToPool(debPath, pkg.Filename, hw)
+		if err != nil {
+			return pkgVersion{}, err
+		}
+		pkg.Size = uint64(hw.Written())
+		pkg.Sha1 = hw.Sha1()
+		pkg.Sha256 = hw.Sha256()
+		pkg.Md5 = hw.Md5()
 	}
-	pkg.Size = uint64(size)
-	pkg.Sha1 = hw.Sha1()
-	pkg.Sha256 = hw.Sha256()
-	pkg.Md5 = hw.Md5()
+	pkg.Added = time.Now().UTC()
+	r.Contents[pkg.Filename] = files
 
-	arches, err := r.getArch(arch)
-	if err != nil {
-		return err
+	for _, pkgs := range arches {
+		pkgs.add(pkgName, version, pkg)
 	}
+	return pkgVersion{pkgName, version}, nil
+}
 
-	for _, pkgs := range arches {
-		set, found := pkgs[pkgName]
-		if !found {
-			set = make(PackageSet)
-		}
-		set[version] = pkg
-		pkgs[pkgName] = set
+// group returns the PackageGroup for the given component and architecture,
+// creating it if it doesn't exist yet.
+func (d *Dist) group(component, arch string) PackageGroup {
+	rp, found := d.Components[component]
+	if !found {
+		rp = make(RepoPackages)
+		d.Components[component] = rp
 	}
+	pg, found := rp[arch]
+	if !found {
+		pg = make(PackageGroup)
+		rp[arch] = pg
+	}
+	return pg
+}
+
+func (r *Repo) hasDist(codename string) bool {
+	return contains(r.Config.Codenames, codename)
+}
 
-	return r.Save()
+func (r *Repo) hasComponent(component string) bool {
+	return contains(r.Config.Components, component)
 }
 
-func (r *Repo) getArch(arch string) ([]map[string]PackageSet, error) {
-	switch strings.ToLower(arch) {
-	case "i386":
-		return []map[string]PackageSet{r.Packages.I386}, nil
-	case "amd64":
-		return []map[string]PackageSet{r.Packages.Amd64}, nil
-	case "all":
-		return []map[string]PackageSet{r.Packages.I386, r.Packages.Amd64}, nil
-	case "source":
-		return []map[string]PackageSet{r.Packages.Source}, nil
+func (r *Repo) hasArch(arch string) bool {
+	return contains(r.Config.Architectures, arch)
+}
+
+// groupNames returns the names of all the PackageGroups that are published
+// for the repo, i.e. the configured architectures followed by "source".
+func (r *Repo) groupNames() []string {
+	names := make([]string, 0, len(r.Config.Architectures)+1)
+	names = append(names, r.Config.Architectures...)
+	return append(names, "source")
+}
+
+func (r *Repo) getArch(codename, component, arch string) ([]PackageGroup, error) {
+	if !r.hasDist(codename) {
+		log.Printf("Unknown codename: %s\n", codename)
+		return nil, fmt.Errorf("Unknown codename: %s", codename)
+	}
+	if !r.hasComponent(component) {
+		log.Printf("Unknown component: %s\n", component)
+		return nil, fmt.Errorf("Unknown component: %s", component)
+	}
+	d := r.dist(codename)
+	arch = strings.ToLower(arch)
+	switch {
+	case arch == "all":
+		groups := make([]PackageGroup, 0, len(r.Config.Architectures))
+		for _, a := range r.Config.Architectures {
+			groups = append(groups, d.group(component, a))
+		}
+		return groups, nil
+	case arch == "source" || r.hasArch(arch):
+		return []PackageGroup{d.group(component, arch)}, nil
 	default:
 		log.Printf("Unsupported architecture: %s\n", arch)
 		return nil, fmt.Errorf("Unsupported arch: %s", arch)
 	}
 }
 
-func (r *Repo) Add(debPath string) error {
-	err := r.signDeb(debPath)
+// fanOutAll makes sure that every "Architecture: all" package in the repo is
+// present in every configured architecture.  This is needed when new
+// architectures are added to an existing repo.
+func (r *Repo) fanOutAll() {
+	for _, d := range r.Dists {
+		for component, rp := range d.Components {
+			all := make(PackageGroup)
+			for _, arch := range r.Config.Architectures {
+				for name, set := range rp[arch] {
+					for version, pkg := range set {
+						if pkg.Control["Architecture"] == "all" {
+							all.add(name, version, pkg)
+						}
+					}
+				}
+			}
+			for _, arch := range r.Config.Architectures {
+				pg := d.group(component, arch)
+				for name, set := range all {
+					for version, pkg := range set {
+						pg.add(name, version, pkg)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Add moves the given .deb file into the pool, and adds it to the given dist
+// and component.  hw should hold the hashes of the file if they were
+// calculated while it was uploaded, otherwise it can be nil.
+func (r *Repo) Add(debPath string, hw *HashWriter, codename, component string) error {
+	added, err := r.addDeb(debPath, hw, codename, component)
 	if err != nil {
 		return err
 	}
-	err = r.parseDeb(debPath)
+	_, removed := r.prune(added)
+	return r.saveAndRemove(removed)
+}
+
+// addDeb does the work of Add, except for applying the retention policy and
+// saving the repo - so that many debs can be added with a single save.  It
+// returns the name and version of the package that was added.
+func (r *Repo) addDeb(debPath string, hw *HashWriter, codename, component string) (pkgVersion, error) {
+	err := r.signDeb(debPath)
 	if err != nil {
-		return err
+		return pkgVersion{}, err
 	}
-	return nil
+	if r.Config.SignDebs {
+		// Signing changes the contents, so the hashes must be recalculated.
+		hw = nil
+	}
+	return r.parseDeb(debPath, hw, codename, component)
+}
+
+func (pg PackageGroup) add(name, version string, pkg Package) {
+	set, found := pg[name]
+	if !found {
+		set = make(PackageSet)
+		pg[name] = set
+	}
+	set[version] = pkg
 }
 
-func (pg PackageGroup) remove(name, version string) {
+func (pg PackageGroup) remove(name, version string) (Package, bool) {
 	set, found := pg[name]
 	if !found {
-		return
+		return Package{}, false
+	}
+	pkg, found := set[version]
+	if !found {
+		return Package{}, false
 	}
 	delete(set, version)
 	if len(set) == 0 {
 		delete(pg, name)
 	}
+	return pkg, true
 }
 
-func (r *Repo) Remove(name, version, arch string) error {
-	switch arch {
-	case "i386":
-		r.Packages.I386.remove(name, version)
-	case "amd64":
-		r.Packages.Amd64.remove(name, version)
-	case "source":
-		r.Packages.Source.remove(name, version)
-	default:
-		log.Printf("Attempt to remove %s:%s from unknown arch: %s\n", name, version, arch)
-		return nil
+// poolFiles returns the paths of all the pool files used by the package.
+func (p *Package) poolFiles() []string {
+	if p.Directory == "" {
+		return []string{p.Filename}
 	}
-	// remove file from pool
-	debName := fmt.Sprintf("%s_%s_%s.deb", name, version, arch)
-	path := filepath.Join(repoPath, r.Name, "pool", r.Config.Component, name[0:1], name, debName)
-	err := os.Remove(path)
-	if os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		log.Printf("Failed to delete %s from pool: %s\n", debName, err)
-		return err
+	files := make([]string, len(p.Files))
+	for i, file := range p.Files {
+		files[i] = filepath.Join(p.Directory, file.Name)
 	}
-	return nil
+	return files
 }
 
-func (pg PackageGroup) packages(group string, packages PackageDetails) {
-	for name := range pg {
-		_, found := packages[name]
-		if !found {
-			packages[name] = make(map[string][]string)
+// poolHashes returns the SHA256 of each of the pool files used by the package,
+// keyed by path.
+func (p *Package) poolHashes() map[string]string {
+	if p.Directory == "" {
+		return map[string]string{p.Filename: p.Sha256}
+	}
+	sums := make(map[string]string, len(p.Files))
+	for _, file := range p.Files {
+		sums[filepath.Join(p.Directory, file.Name)] = file.Sha256
+	}
+	return sums
+}
+
+// inUse returns true if any package in any dist of the repo refers to the
+// given pool file.
+func (r *Repo) inUse(filename string) bool {
+	_, found := r.usedBy(filename)
+	return found
+}
+
+// usedBy returns a package that uses the given pool file, if there is one.
+func (r *Repo) usedBy(filename string) (Package, bool) {
+	for _, d := range r.Dists {
+		for _, rp := range d.Components {
+			for _, pg := range rp {
+				for _, set := range pg {
+					for _, pkg := range set {
+						if contains(pkg.poolFiles(), filename) {
+							return pkg, true
+						}
+					}
+				}
+			}
 		}
-		for version := range pg[name] {
-			packages[name][version] = append(packages[name][version], group)
+	}
+	return Package{}, false
+}
+
+// usedOutside returns true if any package uses the given pool file, other
+// than those in the given arches of the given dist and component.
+func (r *Repo) usedOutside(filename, codename, component string, arches []string) bool {
+	for cn, d := range r.Dists {
+		for comp, rp := range d.Components {
+			for arch, pg := range rp {
+				if cn == codename && comp == component && contains(arches, arch) {
+					continue
+				}
+				for _, set := range pg {
+					for _, pkg := range set {
+						if contains(pkg.poolFiles(), filename) {
+							return true
+						}
+					}
+				}
+			}
 		}
 	}
+	return false
 }
 
-func (r *Repo) ListPackages() PackageDetails {
-	packages := make(PackageDetails)
-	r.Packages.I386.packages("i386", packages)
-	r.Packages.Amd64.packages("amd64", packages)
-	r.Packages.Source.packages("source", packages)
-	return packages
+// PoolConflict is returned when a file is added to the pool, but a different
+// file with the same name is already in use.
+type PoolConflict struct {
+	Path string
 }
 
-func (r *Repo) writePackages() error {
-	err := r.Packages.I386.writePackages(r, "binary-i386")
+func (pc *PoolConflict) Error() string {
+	return fmt.Sprintf("%s already in pool with different contents", pc.Path)
+}
+
+// sameDeb returns true if the deb d (at debPath, with hashes hw if known) has
+// the same contents as the pool file of pkg.  If the repo signs debs then the
+// signatures are ignored, as they are different every time.
+func (r *Repo) sameDeb(d *deb.Deb, debPath string, hw *HashWriter, pkg Package) (bool, error) {
+	if !r.Config.SignDebs {
+		var err error
+		if hw == nil {
+			hw, err = hashFile(debPath)
+			if err != nil {
+				log.Printf("Failed to read '%s': %s\n", debPath, err)
+				return false, err
+			}
+		}
+		return hw.Sha256() == pkg.Sha256, nil
+	}
+	path := filepath.Join(repoPath, r.Name, pkg.Filename)
+	existing, err := deb.Open(path)
 	if err != nil {
-		return err
+		log.Printf("Failed to open deb '%s': %s\n", path, err)
+		return false, err
 	}
-	err = r.writeDeepRelease("binary-i386", "i386")
+	defer existing.Close()
+	a, err := d.ContentHash()
 	if err != nil {
-		return err
+		log.Printf("Failed to read deb '%s': %s\n", debPath, err)
+		return false, err
 	}
-	err = r.Packages.Amd64.writePackages(r, "binary-amd64")
+	b, err := existing.ContentHash()
 	if err != nil {
-		return err
+		log.Printf("Failed to read deb '%s': %s\n", path, err)
+		return false, err
 	}
-	err = r.writeDeepRelease("binary-amd64", "amd64")
+	return a == b, nil
+}
+
+// moveToPool moves the file at src into the repo at dest (relative to the repo
+// directory), replacing any existing file.  The file is renamed into place if
+// possible, and only copied if src is on a different filesystem.  hw should
+// hold the hashes of src if they are already known, otherwise src is read to
+// calculate them.  The hashes are returned.
+func (r *Repo) moveToPool(src, dest string, hw *HashWriter) (*HashWriter, error) {
+	var err error
+	if hw == nil {
+		hw, err = hashFile(src)
+		if err != nil {
+			log.Printf("Failed to read '%s': %s\n", src, err)
+			return nil, err
+		}
+	}
+	filename := filepath.Join(repoPath, r.Name, dest)
+	destDir := filepath.Dir(filename)
+	err = os.MkdirAll(destDir, 0755)
 	if err != nil {
-		return err
+		log.Printf("Failed to create '%s': %s\n", destDir, err)
+		return nil, err
 	}
-	err = r.Packages.Source.writePackages(r, "source")
+	if storePath != "" {
+		err = storeFile(src, filename, hw.Sha256())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = moveFile(src, filename)
+		if err != nil {
+			log.Printf("Failed to move '%s' -> '%s': %s\n", src, filename, err)
+			return nil, err
+		}
+	}
+	err = blobStore.Put(blobKey(r.Name, dest), filename)
 	if err != nil {
-		return err
+		log.Printf("Failed to store '%s': %s\n", dest, err)
+		return nil, err
+	}
+	return hw, nil
+}
+
+func (r *Repo) Remove(codename, component, name, version, arch string) error {
+	if !r.hasDist(codename) {
+		log.Printf("Attempt to remove %s:%s from unknown codename: %s\n", name, version, codename)
+		return nil
+	}
+	if !r.hasComponent(component) {
+		log.Printf("Attempt to remove %s:%s from unknown component: %s\n", name, version, component)
+		return nil
+	}
+	if arch != "source" && !r.hasArch(arch) {
+		log.Printf("Attempt to remove %s:%s from unknown arch: %s\n", name, version, arch)
+		return nil
+	}
+	pkg, found := r.dist(codename).Components[component][arch].remove(name, version)
+	if !found {
+		return nil
+	}
+	return r.removeUnused(&pkg)
+}
+
+// removeUnused removes the pool files of the given package, unless they are
+// still needed by another package (e.g. an "Architecture: all" package in
+// another arch, or an orig tarball shared by another version of a source
+// package).  Any blobs in the content store that are no longer used by any
+// repo are then freed.
+func (r *Repo) removeUnused(pkg *Package) error {
+	unused := make(map[string]string)
+	for filename, sum := range pkg.poolHashes() {
+		if !r.inUse(filename) {
+			unused[filename] = sum
+		}
 	}
-	err = r.writeDeepRelease("source", "source")
+	return r.removePoolFiles(unused)
+}
+
+// removeUnsaved removes those of the given pool files that aren't used by the
+// repo as it was last saved.  This tidies up after a failed Save, which may or
+// may not have managed to record the files.
+func (r *Repo) removeUnsaved(files map[string]string) error {
+	saved, err := LoadRepo(r.Name)
 	if err != nil {
 		return err
 	}
+	unused := make(map[string]string)
+	for filename, sum := range files {
+		if !saved.inUse(filename) {
+			unused[filename] = sum
+		}
+	}
+	return r.removePoolFiles(unused)
+}
+
+// removePoolFiles removes the given pool files, which map the paths to their
+// SHA256s, and frees their blobs in the content store if no other repo uses
+// them.
+func (r *Repo) removePoolFiles(files map[string]string) error {
+	var sums []string
+	for filename, sum := range files {
+		path := filepath.Join(repoPath, r.Name, filename)
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete %s from pool: %s\n", filename, err)
+			return err
+		}
+		delete(r.Contents, filename)
+		err = blobStore.Delete(blobKey(r.Name, filename))
+		if err != nil {
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	return releaseBlobs(sums)
+}
+
+func (pg PackageGroup) packages(group string, packages PackageDetails) {
+	for name := range pg {
+		_, found := packages[name]
+		if !found {
+			packages[name] = make(map[string][]string)
+		}
+		for version := range pg[name] {
+			packages[name][version] = append(packages[name][version], group)
+		}
+	}
+}
+
+// ListPackages returns the details of the packages in each of the repo's
+// components, for each of its dists.
+func (r *Repo) ListPackages() DistDetails {
+	details := make(DistDetails, len(r.Config.Codenames))
+	for _, codename := range r.Config.Codenames {
+		d := r.dist(codename)
+		components := make(ComponentDetails, len(r.Config.Components))
+		for _, component := range r.Config.Components {
+			packages := make(PackageDetails)
+			for _, arch := range r.groupNames() {
+				d.Components[component][arch].packages(arch, packages)
+			}
+			components[component] = packages
+		}
+		details[codename] = components
+	}
+	return details
+}
+
+func (r *Repo) writePackages(codename string) error {
+	d := r.dist(codename)
+	for _, component := range r.Config.Components {
+		for _, arch := range r.groupNames() {
+			name := "binary-" + arch
+			if arch == "source" {
+				name = "source"
+			}
+			err := d.group(component, arch).writePackages(r, codename, component, name)
+			if err != nil {
+				return err
+			}
+			err = r.writeDeepRelease(codename, component, name, arch)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-func (r *Repo) writeRelease() error {
-	path := filepath.Join(repoPath, r.Name, "dists", r.Config.Codename)
+func (r *Repo) writeRelease(codename string) error {
+	path := r.distPath(codename)
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
 		log.Printf("Failed to create directory '%s': %s\n", path, err)
@@ -463,19 +1196,19 @@ func (r *Repo) writeRelease() error {
 	md5 := "MD5Sum:\n"
 	sha1 := "SHA1:\n"
 	sha256 := "SHA256:\n"
-	for name := range r.Files {
-		file := r.Files[name]
+	files := r.dist(codename).Files
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := files[name]
 		md5 += fmt.Sprintf(" %s %d %s\n", file.Md5, file.Size, name)
 		sha1 += fmt.Sprintf(" %s %d %s\n", file.Sha1, file.Size, name)
 		sha256 += fmt.Sprintf(" %s %d %s\n", file.Sha256, file.Size, name)
 	}
-	s := fmt.Sprintf("Origin: %s\n", r.Config.Origin)
-	s += fmt.Sprintf("Label: %s\n", r.Config.Label)
-	s += fmt.Sprintf("Codename: %s\n", r.Config.Codename)
-	s += fmt.Sprintf("Date: %s\n", time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 MST"))
-	s += fmt.Sprintf("Architectures: i386 amd64\n")
-	s += fmt.Sprintf("Components: %s\n", r.Config.Component)
-	s += fmt.Sprintf("Description: %s\n", r.Config.Description)
+	s := r.releaseHeader(codename)
 	_, err = f.WriteString(s + md5 + sha1 + sha256)
 	if err != nil {
 		log.Printf("Failed to write %s: %s\n", path, err)
@@ -493,8 +1226,8 @@ func (r *Repo) writeRelease() error {
 	return opgp.ClearsignFile(filename, inFilename, r.Config.GpgKey)
 }
 
-func (r *Repo) writeDeepRelease(name, arch string) error {
-	path := filepath.Join(repoPath, r.Name, "dists", r.Config.Codename, r.Config.Component, name)
+func (r *Repo) writeDeepRelease(codename, component, name, arch string) error {
+	path := filepath.Join(r.distPath(codename), component, name)
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
 		log.Printf("Failed to create directory '%s': %s\n", path, err)
@@ -508,22 +1241,34 @@ func (r *Repo) writeDeepRelease(name, arch string) error {
 	}
 	defer f.Close()
 	hw := NewHashWriter(f)
-	s := fmt.Sprintf("Component: %s\n", r.Config.Component)
+	s := ""
+	if suite, ok := r.Config.Suites[codename]; ok {
+		s += fmt.Sprintf("Archive: %s\n", suite)
+	}
+	if r.Config.Version != "" {
+		s += fmt.Sprintf("Version: %s\n", r.Config.Version)
+	}
+	s += fmt.Sprintf("Component: %s\n", component)
 	s += fmt.Sprintf("Origin: %s\n", r.Config.Origin)
 	s += fmt.Sprintf("Label: %s\n", r.Config.Label)
 	s += fmt.Sprintf("Architecture: %s\n", arch)
+	if r.Config.NotAutomatic {
+		s += "NotAutomatic: yes\n"
+		if r.Config.ButAutomaticUpgrades {
+			s += "ButAutomaticUpgrades: yes\n"
+		}
+	}
 	s += fmt.Sprintf("Description: %s\n", r.Config.Description)
 	_, err = hw.Write([]byte(s))
 	if err != nil {
 		log.Printf("Failed to write %s: %s\n", path, err)
 		return err
 	}
-	r.storeHashes(filename, hw)
-	return nil
+	return r.storeHashes(codename, filename, hw)
 }
 
-func (pg PackageGroup) writePackages(r *Repo, name string) error {
-	path := filepath.Join(repoPath, r.Name, "dists", r.Config.Codename, r.Config.Component, name)
+func (pg PackageGroup) writePackages(r *Repo, codename, component, name string) error {
+	path := filepath.Join(r.distPath(codename), component, name)
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
 		log.Printf("Failed to create directory '%s': %s\n", path, err)
@@ -534,53 +1279,85 @@ func (pg PackageGroup) writePackages(r *Repo, name string) error {
 		file = "Sources"
 	}
 	filename := filepath.Join(path, file)
-	gzFilename := filepath.Join(path, file) + ".gz"
-	f, err := os.Create(filename)
+	w, err := r.newIndexWriter(codename, filename, r.Config.Compressions)
 	if err != nil {
-		log.Printf("Failed to create Packages file: %s\n", err)
 		return err
 	}
-	defer f.Close()
-	hw := NewHashWriter(f)
-	f2, err := os.Create(gzFilename)
-	if err != nil {
-		log.Printf("Failed to create Packages file: %s\n", err)
-		return err
-	}
-	defer f2.Close()
-	hw2 := NewHashWriter(f2)
-	gzHw := gzip.NewWriter(hw2)
-	w := io.MultiWriter(hw, gzHw)
-	for name := range pg {
-		for version := range pg[name] {
+	for _, name := range pg.names() {
+		for _, version := range pg[name].versions() {
 			pkg := pg[name][version]
-			err := pkg.appendTo(w)
+			err := pkg.appendTo(w, r.Config.Translations)
 			if err != nil {
-				gzHw.Close()
+				w.abort()
 				return err
 			}
 		}
 	}
-	// We must close the gzip writer so all its output goes to the HashWriter.
-	// A flush is not sufficient (extra bytes get written on Close).
-	gzHw.Close()
-	r.storeHashes(filename, hw)
-	r.storeHashes(gzFilename, hw2)
-	return nil
+	return w.Close()
 }
 
-func (p *Package) appendTo(w io.Writer) error {
-	extra := ""
+// names returns the names of the packages in the group, in sorted order.
+func (pg PackageGroup) names() []string {
+	names := make([]string, 0, len(pg))
+	for name := range pg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// versions returns the versions in the set, sorted using Debian version
+// ordering.
+func (ps PackageSet) versions() []string {
+	versions := make([]string, 0, len(ps))
+	for version := range ps {
+		versions = append(versions, version)
+	}
+	// Versions that dpkg considers equal (e.g. "1.0" and "0:1.0") are
+	// ordered as strings, so that the order doesn't depend on the map.
+	sort.SliceStable(versions, func(i, j int) bool {
+		c := deb.CompareVersions(versions[i], versions[j])
+		if c == 0 {
+			return versions[i] < versions[j]
+		}
+		return c < 0
+	})
+	return versions
+}
+
+// formatField formats a control field for writing to an index file.  Values
+// that start on the line after the field name (e.g. file lists) are stored
+// with a leading newline, so the separating space is omitted for them.
+func formatField(name, value string) string {
+	if strings.HasPrefix(value, "\n") || value == "" {
+		return fmt.Sprintf("%s:%s\n", name, value)
+	}
+	return fmt.Sprintf("%s: %s\n", name, value)
+}
+
+// appendTo writes the index stanza for the package to w.  If shortDesc is true
+// then only the short description is included, along with the Description-md5
+// used to find the full description in the Translation files.
+func (p *Package) appendTo(w io.Writer, shortDesc bool) error {
+	if p.Directory != "" {
+		return p.appendSourceTo(w)
+	}
+	fields := make(map[string]string, len(p.Control)+7)
 	for name, value := range p.Control {
-		extra += fmt.Sprintf("%s: %s\n", name, value)
-	}
-	extra += fmt.Sprintf("Filename: %s\n", p.Filename)
-	extra += fmt.Sprintf("Size: %d\n", p.Size)
-	extra += fmt.Sprintf("SHA1: %s\n", p.Sha1)
-	extra += fmt.Sprintf("SHA256: %s\n", p.Sha256)
-	extra += fmt.Sprintf("MD5Sum: %s\n", p.Md5)
-	extra += fmt.Sprintf("Description: %s\n", p.Description)
-	extra += "\n"
+		fields[name] = value
+	}
+	fields["Filename"] = p.Filename
+	fields["Size"] = fmt.Sprintf("%d", p.Size)
+	fields["SHA1"] = p.Sha1
+	fields["SHA256"] = p.Sha256
+	fields["MD5Sum"] = p.Md5
+	if shortDesc {
+		fields["Description"] = shortDescription(p.Description)
+		fields["Description-md5"] = descriptionMd5(p.Description)
+	} else {
+		fields["Description"] = p.Description
+	}
+	extra := formatStanza(fields, binaryFieldOrder) + "\n"
 	_, err := w.Write([]byte(extra))
 	if err != nil {
 		log.Printf("Failed to append blank line after %s: %s\n", p.Filename, err)
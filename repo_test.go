@@ -0,0 +1,56 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// signed.deb is gz.deb with a signature added, so it looks like a rebuild of
+// the same name_version_arch.
+func TestReplaceDeb(t *testing.T) {
+	setupTestDirs(t)
+	r := newRepo("replace")
+	r.Config.Architectures = []string{"amd64"}
+	r.Config.Codenames = []string{"stable", "testing"}
+	r.Config.Codename = "stable"
+	err := r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := controlRequest(t, "POST", "/c/include/replace/hello.deb?dist=stable", "@deb/testdata/gz.deb")
+	if code != http.StatusOK {
+		t.Fatalf("include: got %d", code)
+	}
+	// Only stable uses the file, so it is replaced.
+	code = controlRequest(t, "POST", "/c/include/replace/hello.deb?dist=stable", "@deb/testdata/signed.deb")
+	if code != http.StatusOK {
+		t.Fatalf("rebuilt include into the only dist using it: got %d", code)
+	}
+	signed, err := hashFile("deb/testdata/signed.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = LoadRepo("replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg, _ := r.find("stable", "main", "amd64", "hello", "1.0-1")
+	if pkg.Sha256 != signed.Sha256() {
+		t.Errorf("package not replaced: got Sha256 %s, want %s", pkg.Sha256, signed.Sha256())
+	}
+
+	// Once testing uses the file too, it can't be replaced by either.
+	code = controlRequest(t, "POST", "/c/include/replace/hello.deb?dist=testing", "@deb/testdata/signed.deb")
+	if code != http.StatusOK {
+		t.Fatalf("include of the same deb into testing: got %d", code)
+	}
+	code = controlRequest(t, "POST", "/c/include/replace/hello.deb?dist=stable", "@deb/testdata/gz.deb")
+	if code != http.StatusConflict {
+		t.Errorf("rebuilt include of a shared deb: got %d, want %d", code, http.StatusConflict)
+	}
+}
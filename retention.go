@@ -0,0 +1,167 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// PrunedPackage identifies a package version that has been (or would be)
+// removed by the retention policy.
+type PrunedPackage struct {
+	Dist      string `json:"dist"`
+	Component string `json:"component"`
+	Arch      string `json:"arch"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+// pkgVersion identifies a version of a package, in whichever dists and arches
+// it is in.
+type pkgVersion struct {
+	name    string
+	version string
+}
+
+// checkRetentionConfig makes sure that the retention policy settings are
+// valid.
+func (c *RepoConfig) checkRetentionConfig() error {
+	if c.KeepVersions < 0 {
+		return fmt.Errorf("keep_versions may not be negative")
+	}
+	_, err := parsePeriod(c.KeepFor)
+	return err
+}
+
+// updateRetentionConfig applies the retention policy settings to a
+// RepoConfig.
+func updateRetentionConfig(c *RepoConfig, settings map[string]string) error {
+	val, ok := settings["keep-versions"]
+	if ok {
+		keep, err := strconv.ParseUint(val, 10, 16)
+		if err != nil {
+			return err
+		}
+		c.KeepVersions = int(keep)
+	}
+	val, ok = settings["keep-for"]
+	if ok {
+		c.KeepFor = val
+	}
+	return c.checkRetentionConfig()
+}
+
+// added returns when the package was added to the repo.  Packages added
+// before this was recorded use the modification time of their pool file.
+func (r *Repo) added(pkg *Package) time.Time {
+	if !pkg.Added.IsZero() {
+		return pkg.Added
+	}
+	info, err := os.Stat(filepath.Join(repoPath, r.Name, pkg.Filename))
+	if err != nil {
+		// If we can't tell how old it is, then treat it as new so that it
+		// isn't removed by mistake.
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
+// expired returns the package versions that should be removed under the
+// retention policy.  A version is kept if it is one of the newest
+// KeepVersions versions of the package in its arch, or if it was added less
+// than KeepFor ago.  The newest version of a package is always kept, as are
+// the versions listed in keep.
+func (r *Repo) expired(now time.Time, keep ...pkgVersion) []PrunedPackage {
+	keepFor, _ := parsePeriod(r.Config.KeepFor)
+	keepVersions := r.Config.KeepVersions
+	if keepVersions == 0 && keepFor == 0 {
+		return nil
+	}
+	kept := make(map[pkgVersion]bool, len(keep))
+	for _, v := range keep {
+		kept[v] = true
+	}
+	var expired []PrunedPackage
+	for _, codename := range r.Config.Codenames {
+		d := r.dist(codename)
+		for _, component := range r.Config.Components {
+			for _, arch := range r.groupNames() {
+				pg := d.group(component, arch)
+				for _, name := range pg.names() {
+					versions := pg[name].versions()
+					for i := range versions {
+						// versions are oldest first, so work out how many
+						// newer versions there are.
+						newer := len(versions) - 1 - i
+						if newer == 0 || (keepVersions > 0 && newer < keepVersions) {
+							continue
+						}
+						if kept[pkgVersion{name, versions[i]}] {
+							continue
+						}
+						pkg := pg[name][versions[i]]
+						if keepFor > 0 && now.Sub(r.added(&pkg)) < keepFor {
+							continue
+						}
+						expired = append(expired, PrunedPackage{codename, component, arch, name, versions[i]})
+					}
+				}
+			}
+		}
+	}
+	return expired
+}
+
+// prune removes the expired package versions from the repo metadata,
+// returning what was removed.  The versions listed in keep are not removed,
+// so that a version that has just been added (e.g. an upload of an old
+// version) isn't pruned straight away.  Nothing is removed from the pool.
+func (r *Repo) prune(keep ...pkgVersion) ([]PrunedPackage, []Package) {
+	expired := r.expired(time.Now(), keep...)
+	var removed []Package
+	for _, p := range expired {
+		pkg, found := r.dist(p.Dist).group(p.Component, p.Arch).remove(p.Name, p.Version)
+		if found {
+			removed = append(removed, pkg)
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("Pruning %d package versions from %s\n", len(expired), r.Name)
+	}
+	return expired, removed
+}
+
+// saveAndRemove saves the repo, and then removes the pool files of the given
+// packages that are no longer used.  The indices are written out before
+// deleting anything from the pool, so that the published indices never refer
+// to missing files.
+func (r *Repo) saveAndRemove(removed []Package) error {
+	err := r.Save()
+	if err != nil {
+		return err
+	}
+	for i := range removed {
+		err = r.removeUnused(&removed[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes all the package versions that have expired under the
+// retention policy.  The repo is only saved if something was removed.
+func (r *Repo) Prune() ([]PrunedPackage, error) {
+	expired, removed := r.prune()
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	return expired, r.saveAndRemove(removed)
+}
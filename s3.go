@@ -0,0 +1,399 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store keeps the files in a bucket of an S3 compatible object store (e.g.
+// AWS S3 or MinIO), under an optional key prefix.  Requests are made using
+// path style URLs (i.e. <endpoint>/<bucket>/<key>), and signed with AWS
+// Signature Version 4.
+//
+// The bucket is only a published copy - the repos are still built in, and
+// keep all their files in, the repos directory, so that still needs the space
+// for a full copy of everything that is published.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+}
+
+// emptySha256 is the SHA256 of an empty request body.
+const emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func openS3Store() (*s3Store, error) {
+	s := &s3Store{}
+	endpoint, err := cfg.Get("s3.endpoint", "")
+	if err != nil {
+		return nil, err
+	}
+	s.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.endpoint.Scheme != "http" && s.endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("s3.endpoint must be an http or https URL")
+	}
+	s.region, err = cfg.Get("s3.region", "us-east-1")
+	if err != nil {
+		return nil, err
+	}
+	s.bucket, err = cfg.Get("s3.bucket", "")
+	if err != nil {
+		return nil, err
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("no s3.bucket given")
+	}
+	s.prefix, err = cfg.Get("s3.prefix", "")
+	if err != nil {
+		return nil, err
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+	// The credentials can also be given in the environment, so that they
+	// don't have to be written in the config file.
+	s.accessKey, err = cfg.Get("s3.access-key", os.Getenv("AWS_ACCESS_KEY_ID"))
+	if err != nil {
+		return nil, err
+	}
+	s.secretKey, err = cfg.Get("s3.secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("no s3 credentials given")
+	}
+	return s, nil
+}
+
+// uriEncode escapes s as required by Signature Version 4, which is stricter
+// than url.PathEscape.
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery returns the query parameters encoded and sorted as required
+// by Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(key, false)+"="+uriEncode(value, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// url returns the URL of the given object (or of the bucket, if key is "").
+func (s *s3Store) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/"
+	if key != "" {
+		u.Path += s.prefix + key
+	}
+	u.RawPath = uriEncode(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds a Signature Version 4 Authorization header to req, signing the
+// host and all the headers already set.  payloadHash is the hex SHA256 of
+// the request body.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+s.secretKey), amzDate[:8])
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// do signs and sends req.
+func (s *s3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now())
+	return http.DefaultClient.Do(req)
+}
+
+// readS3Error returns the error code and message from the body of a failed
+// request.  They are empty if there is no body (e.g. for a HEAD request).
+func readS3Error(resp *http.Response) (code, message string) {
+	var body struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+	return body.Code, body.Message
+}
+
+// s3Error returns an error describing a failed request, including the message
+// from the response body.
+func s3Error(op, key string, resp *http.Response) error {
+	code, message := readS3Error(resp)
+	if code != "" {
+		return fmt.Errorf("s3 %s '%s': %s: %s (%s)", op, key, resp.Status, message, code)
+	}
+	return fmt.Errorf("s3 %s '%s': %s", op, key, resp.Status)
+}
+
+func (s *s3Store) Put(key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.url(key, nil).String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		log.Printf("Failed to put '%s': %s\n", key, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = s3Error("put", key, resp)
+		log.Printf("Failed to put '%s': %s\n", key, err)
+		return err
+	}
+	return nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", s.url(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptySha256)
+	if err != nil {
+		log.Printf("Failed to delete '%s': %s\n", key, err)
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	err = s3Error("delete", key, resp)
+	log.Printf("Failed to delete '%s': %s\n", key, err)
+	return err
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.prefix + prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest("GET", s.url("", query).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptySha256)
+		if err != nil {
+			log.Printf("Failed to list '%s': %s\n", prefix, err)
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error("list", prefix, resp)
+			resp.Body.Close()
+			log.Printf("Failed to list '%s': %s\n", prefix, err)
+			return nil, err
+		}
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Failed to read list of '%s': %s\n", prefix, err)
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(obj.Key, s.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Store) Handler() http.Handler {
+	return s
+}
+
+// ServeHTTP serves files by fetching them from the bucket.  The client's
+// conditional and range headers are passed on, so apt can still use them.
+func (s *s3Store) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "405: Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if key == "" || strings.HasSuffix(req.URL.Path, "/") {
+		// There are no directory listings.
+		http.Error(w, "404: Not Found", http.StatusNotFound)
+		return
+	}
+	sreq, err := http.NewRequest(req.Method, s.url(key, nil).String(), nil)
+	if err != nil {
+		http.Error(w, "500: Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, name := range []string{"Range", "If-Modified-Since", "If-None-Match"} {
+		if value := req.Header.Get(name); value != "" {
+			sreq.Header.Set(name, value)
+		}
+	}
+	resp, err := s.do(sreq, emptySha256)
+	if err != nil {
+		log.Printf("Failed to get '%s': %s\n", key, err)
+		http.Error(w, "502: Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		http.Error(w, "404: Not Found", http.StatusNotFound)
+		return
+	case resp.StatusCode == http.StatusForbidden:
+		// Without permission to list the bucket, S3 reports missing keys
+		// as AccessDenied - but anything else (e.g. SignatureDoesNotMatch
+		// or InvalidAccessKeyId) is a problem with our credentials, which
+		// mustn't be hidden.
+		code, message := readS3Error(resp)
+		log.Printf("Access denied getting '%s': %s (%s)\n", key, message, code)
+		if code == "" || code == "AccessDenied" {
+			http.Error(w, "404: Not Found", http.StatusNotFound)
+		} else {
+			http.Error(w, "502: Bad Gateway", http.StatusBadGateway)
+		}
+		return
+	case resp.StatusCode >= 400:
+		log.Printf("Failed to get '%s': %s\n", key, s3Error("get", key, resp))
+		http.Error(w, "502: Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,237 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A snapshot is a frozen copy of a repo, stored as snapshots/<name> inside
+// the repo directory (so it is served as /r/<repo>/snapshots/<name>/).  It is
+// a complete repo in its own right, with its own metadata, dists and pool - but
+// the pool files are hard links to those of the repo, so they take no extra
+// space.  Nothing ever modifies a snapshot once it has been created, and since
+// pool files are always replaced rather than written to, later changes to the
+// repo don't affect it.
+
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+func (r *Repo) snapshotsPath() string {
+	return filepath.Join(repoPath, r.Name, "snapshots")
+}
+
+func validSnapshotName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// Snapshot creates a new snapshot of the current state of the repo.  If a
+// snapshot with the given name already exists then the error will satisfy
+// os.IsExist.
+func (r *Repo) Snapshot(name string) error {
+	if !validSnapshotName(name) {
+		return fmt.Errorf("invalid snapshot name '%s'", name)
+	}
+	base := r.snapshotsPath()
+	path := filepath.Join(base, name)
+	_, err := os.Stat(path)
+	if err == nil {
+		return &os.PathError{Op: "snapshot", Path: path, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Failed to stat '%s': %s\n", path, err)
+		return err
+	}
+	err = os.MkdirAll(base, 0755)
+	if err != nil {
+		log.Printf("Failed to create directory '%s': %s\n", base, err)
+		return err
+	}
+
+	// The snapshot is built in a temporary directory, and then renamed into
+	// place once it is complete.
+	dir, err := ioutil.TempDir(base, "."+name+".")
+	if err != nil {
+		log.Printf("Failed to create snapshot directory: %s\n", err)
+		return err
+	}
+	var snap *Repo
+	err = os.Chmod(dir, 0755)
+	if err == nil {
+		snap, err = r.writeSnapshot(dir)
+	}
+	if err == nil {
+		err = os.Rename(dir, path)
+		if err != nil {
+			log.Printf("Failed to rename '%s' -> '%s': %s\n", dir, path, err)
+		}
+		// The metadata was saved under the temporary name, so it needs to
+		// be moved too.
+		tmpName := snap.Name
+		if err == nil {
+			snap.Name = filepath.Join(r.Name, "snapshots", name)
+			err = snap.finishSnapshot()
+			if err != nil {
+				os.RemoveAll(path)
+				metaStore.Delete(snap.Name)
+				deleteBlobs(blobKey(snap.Name) + "/")
+			}
+		}
+		metaStore.Delete(tmpName)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// writeSnapshot links the pool files into the snapshot directory, and then
+// saves a copy of the repo there.
+func (r *Repo) writeSnapshot(dir string) (*Repo, error) {
+	rel, err := filepath.Rel(repoPath, dir)
+	if err != nil {
+		return nil, err
+	}
+	snap := newRepo(rel)
+	snap.Config = r.Config
+	// Nothing rewrites a snapshot's Release files or prunes it, so these
+	// settings would only make it expire.
+	snap.Config.ValidFor = ""
+	snap.Config.KeepVersions = 0
+	snap.Config.KeepFor = ""
+	snap.Contents = r.Contents
+	snap.Dists = make(map[string]*Dist, len(r.Dists))
+	linked := make(map[string]bool)
+	for codename, d := range r.Dists {
+		// The index files and by-hash history belong to the repo, the
+		// snapshot starts out with its own.
+		snap.Dists[codename] = &Dist{
+			Components: d.Components,
+			Files:      make(map[string]RepoFile),
+			ByHash:     make(map[string][]RepoFile),
+		}
+		for _, rp := range d.Components {
+			for _, pg := range rp {
+				for _, set := range pg {
+					for _, pkg := range set {
+						for _, filename := range pkg.poolFiles() {
+							if linked[filename] {
+								continue
+							}
+							err := linkPoolFile(filepath.Join(repoPath, r.Name, filename), filepath.Join(dir, filename))
+							if err != nil {
+								log.Printf("Failed to add '%s' to snapshot: %s\n", filename, err)
+								return nil, err
+							}
+							linked[filename] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	// The snapshot isn't copied to the blob store until it has its final
+	// name, so it isn't saved with Save.
+	err = snap.writeDists()
+	if err == nil {
+		err = snap.writeMeta()
+	}
+	if err != nil {
+		metaStore.Delete(rel)
+		return nil, err
+	}
+	return snap, nil
+}
+
+// finishSnapshot saves the metadata of the snapshot once it has been renamed
+// to its final name, and copies it to the blob store.
+func (r *Repo) finishSnapshot() error {
+	err := r.writeMeta()
+	if err == nil {
+		err = r.uploadPool()
+	}
+	if err == nil {
+		err = r.uploadDists()
+	}
+	return err
+}
+
+// linkPoolFile hard links the pool file at src to dest, falling back to
+// copying if linking fails.
+func linkPoolFile(src, dest string) error {
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	if os.Link(src, dest) == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+// Snapshots returns the snapshots of the repo, in name order.
+func (r *Repo) Snapshots() ([]Snapshot, error) {
+	snapshots := []Snapshot{}
+	files, err := ioutil.ReadDir(r.snapshotsPath())
+	if os.IsNotExist(err) {
+		return snapshots, nil
+	} else if err != nil {
+		log.Printf("Failed to ReadDir(%s): %s\n", r.snapshotsPath(), err)
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name:    file.Name(),
+			Created: file.ModTime().UTC(),
+		})
+	}
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes the named snapshot.  If it doesn't exist then the
+// error will satisfy os.IsNotExist.
+func (r *Repo) DeleteSnapshot(name string) error {
+	if !validSnapshotName(name) {
+		return &os.PathError{Op: "delete snapshot", Path: name, Err: os.ErrNotExist}
+	}
+	path := filepath.Join(r.snapshotsPath(), name)
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Move the snapshot out of the way first, so that it disappears all at
+	// once rather than a file at a time.
+	tmp := filepath.Join(r.snapshotsPath(), "."+name+".deleted")
+	err = os.Rename(path, tmp)
+	if err != nil {
+		log.Printf("Failed to rename '%s' -> '%s': %s\n", path, tmp, err)
+		return err
+	}
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		log.Printf("Failed to delete snapshot '%s': %s\n", path, err)
+		return err
+	}
+	err = metaStore.Delete(filepath.Join(r.Name, "snapshots", name))
+	if err != nil {
+		return err
+	}
+	err = deleteBlobs(blobKey(r.Name, "snapshots", name) + "/")
+	if err != nil {
+		return err
+	}
+	return sweepStore()
+}
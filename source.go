@@ -0,0 +1,189 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"repo_server/deb"
+)
+
+// AddSource adds the source package described by the given .dsc file to the
+// repo.  All the files listed in the .dsc must be in the same directory as
+// the .dsc itself.
+func (r *Repo) AddSource(dscPath, codename, component string) error {
+	d, err := deb.ParseDsc(dscPath)
+	if err != nil {
+		log.Printf("Failed to parse dsc '%s': %s\n", dscPath, err)
+		return err
+	}
+	err = d.Verify(filepath.Dir(dscPath))
+	if err != nil {
+		log.Printf("Failed to verify dsc '%s': %s\n", dscPath, err)
+		return err
+	}
+
+	name := d.Control["Source"]
+	version := d.Control["Version"]
+	v, err := deb.ParseVersion(version)
+	if err != nil {
+		log.Printf("dsc has invalid version: %s: %s\n", dscPath, err)
+		return err
+	}
+	if strings.ContainsAny(name, "/ \t\n") || strings.HasPrefix(name, ".") {
+		log.Printf("dsc has invalid source name '%s': %s\n", name, dscPath)
+		return fmt.Errorf("invalid source name in %s", dscPath)
+	}
+
+	groups, err := r.getArch(codename, component, "source")
+	if err != nil {
+		return err
+	}
+
+	pkg := Package{
+		Control:   d.Control,
+		Directory: fmt.Sprintf("pool/%s/%s/%s", component, name[0:1], name),
+	}
+
+	// The .dsc is stored under its canonical name, which doesn't include the
+	// epoch.
+	v.Epoch = 0
+	dscName := fmt.Sprintf("%s_%s.dsc", name, v)
+	// added holds the files that this upload has put in the pool, so that
+	// they can be removed again if it fails.
+	added := make(map[string]string)
+	hw, err := r.addToPool(dscPath, filepath.Join(pkg.Directory, dscName), added)
+	if err != nil {
+		return err
+	}
+	pkg.Filename = filepath.Join(pkg.Directory, dscName)
+	pkg.Size = uint64(hw.Written())
+	pkg.Sha1 = hw.Sha1()
+	pkg.Sha256 = hw.Sha256()
+	pkg.Md5 = hw.Md5()
+	pkg.Files = append(pkg.Files, deb.SourceFile{
+		Name:   dscName,
+		Size:   pkg.Size,
+		Md5:    pkg.Md5,
+		Sha1:   pkg.Sha1,
+		Sha256: pkg.Sha256,
+	})
+
+	for _, file := range d.Files {
+		src := filepath.Join(filepath.Dir(dscPath), file.Name)
+		hw, err := r.addToPool(src, filepath.Join(pkg.Directory, file.Name), added)
+		if err != nil {
+			r.removePoolFiles(added)
+			return err
+		}
+		// Not all .dsc files have all the checksums, but we want them all
+		// for the Sources index.
+		pkg.Files = append(pkg.Files, deb.SourceFile{
+			Name:   file.Name,
+			Size:   uint64(hw.Written()),
+			Md5:    hw.Md5(),
+			Sha1:   hw.Sha1(),
+			Sha256: hw.Sha256(),
+		})
+	}
+
+	// We regenerate the file lists in the Sources index, so drop any other
+	// checksum fields that we don't know how to generate.
+	for field := range pkg.Control {
+		if strings.HasPrefix(field, "Checksums-") {
+			delete(pkg.Control, field)
+		}
+	}
+
+	pkg.Added = time.Now().UTC()
+	for _, pkgs := range groups {
+		pkgs.add(name, version, pkg)
+	}
+
+	_, removed := r.prune(pkgVersion{name, version})
+	err = r.saveAndRemove(removed)
+	if err != nil {
+		r.removeUnsaved(added)
+		return err
+	}
+	return nil
+}
+
+// addToPool moves src into the repo at the given path (relative to the repo
+// directory), recording it in added.  If another package already uses the
+// destination (e.g. an orig tarball shared with another version), then it
+// must have the same contents as src, and is left alone.  A file that isn't
+// in use (e.g. left behind by a failed upload) is just replaced.
+func (r *Repo) addToPool(src, dest string, added map[string]string) (*HashWriter, error) {
+	hw, err := hashFile(src)
+	if err != nil {
+		log.Printf("Failed to read '%s': %s\n", src, err)
+		return nil, err
+	}
+	if existing, found := r.usedBy(dest); found {
+		if hw.Sha256() != existing.poolHashes()[dest] {
+			log.Printf("'%s' already exists with different contents\n", dest)
+			return nil, &PoolConflict{dest}
+		}
+		return hw, nil
+	}
+	hw, err = r.moveToPool(src, dest, hw)
+	if err != nil {
+		return nil, err
+	}
+	added[dest] = hw.Sha256()
+	return hw, nil
+}
+
+// hashFile returns a HashWriter that has had the contents of the given file
+// written to it.
+func hashFile(filename string) (*HashWriter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hw := NewHashWriter(ioutil.Discard)
+	_, err = io.Copy(hw, f)
+	if err != nil {
+		return nil, err
+	}
+	return hw, nil
+}
+
+func (p *Package) appendSourceTo(w io.Writer) error {
+	fields := make(map[string]string, len(p.Control)+4)
+	for name, value := range p.Control {
+		if name == "Source" {
+			continue
+		}
+		fields[name] = value
+	}
+	fields["Package"] = p.Control["Source"]
+	fields["Directory"] = p.Directory
+	files, sha1s, sha256s := "", "", ""
+	for _, file := range p.Files {
+		files += fmt.Sprintf("\n %s %d %s", file.Md5, file.Size, file.Name)
+		sha1s += fmt.Sprintf("\n %s %d %s", file.Sha1, file.Size, file.Name)
+		sha256s += fmt.Sprintf("\n %s %d %s", file.Sha256, file.Size, file.Name)
+	}
+	fields["Files"] = files
+	fields["Checksums-Sha1"] = sha1s
+	fields["Checksums-Sha256"] = sha256s
+	extra := formatStanza(fields, sourceFieldOrder) + "\n"
+	_, err := w.Write([]byte(extra))
+	if err != nil {
+		log.Printf("Failed to append source stanza for %s: %s\n", p.Filename, err)
+		return err
+	}
+	return nil
+}
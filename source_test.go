@@ -0,0 +1,134 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"repo_server/deb"
+)
+
+func TestAppendSource(t *testing.T) {
+	pkg := Package{
+		Control: map[string]string{
+			"Source":  "hello",
+			"Version": "1.0-1",
+			"Format":  "3.0 (quilt)",
+			"Binary":  "hello",
+		},
+		Directory: "pool/main/h/hello",
+		Files: []deb.SourceFile{
+			{Name: "hello_1.0-1.dsc", Size: 10, Md5: "m1", Sha1: "s1", Sha256: "h1"},
+			{Name: "hello_1.0.orig.tar.gz", Size: 20, Md5: "m2", Sha1: "s2", Sha256: "h2"},
+		},
+	}
+	var b bytes.Buffer
+	err := pkg.appendSourceTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Package: hello
+Format: 3.0 (quilt)
+Binary: hello
+Version: 1.0-1
+Directory: pool/main/h/hello
+Files:
+ m1 10 hello_1.0-1.dsc
+ m2 20 hello_1.0.orig.tar.gz
+Checksums-Sha1:
+ s1 10 hello_1.0-1.dsc
+ s2 20 hello_1.0.orig.tar.gz
+Checksums-Sha256:
+ h1 10 hello_1.0-1.dsc
+ h2 20 hello_1.0.orig.tar.gz
+
+`
+	if b.String() != want {
+		t.Errorf("got stanza:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+// writeSource writes a .dsc for the given version of hello into a new
+// directory, along with its files (given as name, contents pairs), and returns
+// the path of the .dsc.
+func writeSource(t *testing.T, version string, files ...string) string {
+	dir := t.TempDir()
+	list := ""
+	for i := 0; i < len(files); i += 2 {
+		name, data := files[i], files[i+1]
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hw, err := hashFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list += fmt.Sprintf("\n %s %d %s", hw.Md5(), hw.Written(), name)
+	}
+	dsc := filepath.Join(dir, "hello_"+version+".dsc")
+	text := fmt.Sprintf("Format: 3.0 (quilt)\nSource: hello\nVersion: %s\nFiles:%s\n", version, list)
+	err := ioutil.WriteFile(dsc, []byte(text), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dsc
+}
+
+// A failed upload mustn't leave files in the pool that stop it from being
+// corrected.
+func TestAddSourceFailureCleanup(t *testing.T) {
+	setupTestDirs(t)
+	r := newRepo("src")
+	err := r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codename := r.Config.Codename
+	err = r.AddSource(writeSource(t, "1.0-1",
+		"hello_1.0.orig.tar.gz", "orig",
+		"hello_1.0-1.debian.tar.xz", "debian 1",
+	), codename, "main")
+	if err != nil {
+		t.Fatalf("AddSource of 1.0-1 failed: %s", err)
+	}
+
+	// The orig tarball doesn't match the one that 1.0-1 uses, which isn't
+	// noticed until the debian tarball is already in the pool.
+	err = r.AddSource(writeSource(t, "1.0-2",
+		"hello_1.0-2.debian.tar.xz", "debian 2",
+		"hello_1.0.orig.tar.gz", "different orig",
+	), codename, "main")
+	if _, ok := err.(*PoolConflict); !ok {
+		t.Fatalf("AddSource with a conflicting orig: got %v, want *PoolConflict", err)
+	}
+	for _, name := range []string{"hello_1.0-2.dsc", "hello_1.0-2.debian.tar.xz"} {
+		_, err = os.Stat(filepath.Join(repoPath, "src", "pool/main/h/hello", name))
+		if !os.IsNotExist(err) {
+			t.Errorf("%s left in the pool after the failed upload", name)
+		}
+	}
+
+	r, err = LoadRepo("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.AddSource(writeSource(t, "1.0-2",
+		"hello_1.0-2.debian.tar.xz", "debian 2, fixed",
+		"hello_1.0.orig.tar.gz", "orig",
+	), codename, "main")
+	if err != nil {
+		t.Fatalf("corrected AddSource of 1.0-2 failed: %s", err)
+	}
+	if _, found := r.find(codename, "main", "source", "hello", "1.0-2"); !found {
+		t.Errorf("1.0-2 not added")
+	}
+}
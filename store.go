@@ -0,0 +1,234 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// The content store is an optional directory (path.store in the config),
+// shared by all the repos, that holds a single copy of every pool file named
+// by its SHA256.  The files in the pool of each repo are hard links to the
+// blobs in the store, so a .deb that is included into many repos only takes up
+// space once.  The link count of a blob is used as its reference count - once
+// the store holds the only link, no repo is using the blob and it is removed.
+
+// storeLock must be held while changing the store, along with an flock on the
+// .lock file in the store directory to exclude other processes.
+var storeLock sync.Mutex
+
+func lockStore() (func(), error) {
+	storeLock.Lock()
+	path := filepath.Join(storePath, ".lock")
+	f, err := flock(path)
+	if err != nil {
+		storeLock.Unlock()
+		log.Printf("Failed to lock '%s': %s\n", path, err)
+		return nil, err
+	}
+	return func() {
+		f.Close()
+		storeLock.Unlock()
+	}, nil
+}
+
+// blobPath returns the path in the store of the blob with the given SHA256.
+func blobPath(sum string) string {
+	return filepath.Join(storePath, sum[:2], sum)
+}
+
+// links returns the number of hard links to the file.
+func links(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+// moveFile renames src to dest, falling back to copying if they are on
+// different filesystems.  An existing dest is always replaced rather than
+// written to, as it may be a hard link shared with the store or a snapshot.
+func moveFile(src, dest string) error {
+	err := os.Rename(src, dest)
+	if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+		tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+		err = copyFile(src, tmp)
+		if err == nil {
+			err = os.Rename(tmp, dest)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		os.Remove(src)
+	}
+	return err
+}
+
+// storeFile moves the file at src (with the given SHA256) into the store,
+// unless the store already has a copy, and then links dest to the blob.  If
+// dest was a link to a different blob, then that blob is released.
+func storeFile(src, dest, sum string) error {
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	blob := blobPath(sum)
+	info, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(blob), 0755)
+		if err != nil {
+			log.Printf("Failed to create '%s': %s\n", filepath.Dir(blob), err)
+			return err
+		}
+		err = moveFile(src, blob)
+		if err != nil {
+			log.Printf("Failed to move '%s' -> '%s': %s\n", src, blob, err)
+			return err
+		}
+		info, err = os.Stat(blob)
+	} else if err == nil {
+		os.Remove(src)
+	}
+	if err != nil {
+		log.Printf("Failed to stat '%s': %s\n", blob, err)
+		return err
+	}
+
+	oldSum := ""
+	old, err := os.Stat(dest)
+	if err == nil {
+		if os.SameFile(old, info) {
+			return nil
+		}
+		hw, err := hashFile(dest)
+		if err != nil {
+			log.Printf("Failed to read existing '%s': %s\n", dest, err)
+			return err
+		}
+		oldSum = hw.Sha256()
+	}
+
+	// Link to a temporary name and rename it into place, so that an existing
+	// file is replaced rather than written to - it may be a link to a blob
+	// that other repos are using.
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".link")
+	os.Remove(tmp)
+	err = os.Link(blob, tmp)
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		log.Printf("Failed to link '%s' -> '%s': %s\n", blob, dest, err)
+		os.Remove(tmp)
+		return err
+	}
+
+	if oldSum != "" {
+		return releaseLocked(oldSum)
+	}
+	return nil
+}
+
+// checkStore makes sure that files in the store can be linked into the repos,
+// which means that they must be on the same filesystem.  Copies would not
+// count as references to the blobs, so nothing would be shared and sweepStore
+// would remove blobs that are still in use.
+func checkStore() error {
+	f, err := ioutil.TempFile(storePath, ".check.")
+	if err != nil {
+		log.Printf("Failed to create file in store: %s\n", err)
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	link := filepath.Join(repoPath, filepath.Base(f.Name()))
+	err = os.Link(f.Name(), link)
+	if err != nil {
+		return fmt.Errorf("can't link from path.store into path.repos, they must be on the same filesystem: %s", err)
+	}
+	os.Remove(link)
+	return nil
+}
+
+// releaseBlobs removes the blobs with the given SHA256s from the store if no
+// repo uses them any more.  It should be called after removing the files from
+// the pool.
+func releaseBlobs(sums []string) error {
+	if storePath == "" || len(sums) == 0 {
+		return nil
+	}
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, sum := range sums {
+		err = releaseLocked(sum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseLocked(sum string) error {
+	blob := blobPath(sum)
+	info, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Printf("Failed to stat '%s': %s\n", blob, err)
+		return err
+	}
+	if links(info) > 1 {
+		return nil
+	}
+	err = os.Remove(blob)
+	if err != nil {
+		log.Printf("Failed to remove '%s' from store: %s\n", sum, err)
+		return err
+	}
+	return nil
+}
+
+// sweepStore removes every blob from the store that isn't used by any repo.
+// This is used after deleting a whole repo, rather than releasing the blobs
+// one at a time.
+func sweepStore() error {
+	if storePath == "" {
+		return nil
+	}
+	unlock, err := lockStore()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return filepath.Walk(storePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || filepath.Base(path) == ".lock" {
+			return nil
+		}
+		if links(info) > 1 {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			log.Printf("Failed to remove '%s' from store: %s\n", path, err)
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,209 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// tlsReloader provides the TLS config for the server, reloading the
+// certificate, key and client CA files whenever they change on disk.
+type tlsReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	minVersion uint16
+	clientAuth tls.ClientAuthType
+	interval   time.Duration
+
+	lock    sync.RWMutex
+	config  *tls.Config
+	modTime map[string]time.Time
+}
+
+// loadTLS reads the tls settings from the config file.  If no certificate is
+// configured then TLS is not used, and nil is returned.
+func loadTLS() (*tlsReloader, error) {
+	tr := &tlsReloader{}
+	var err error
+	tr.certFile, err = cfg.Get("tls.cert", "")
+	if err != nil || tr.certFile == "" {
+		return nil, err
+	}
+	tr.keyFile, err = cfg.Get("tls.key", "")
+	if err != nil {
+		return nil, err
+	}
+	if tr.keyFile == "" {
+		return nil, fmt.Errorf("tls.key must be set if tls.cert is")
+	}
+	tr.caFile, err = cfg.Get("tls.client-ca", "")
+	if err != nil {
+		return nil, err
+	}
+	minVersion, err := cfg.Get("tls.min-version", "1.2")
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	tr.minVersion, ok = tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version '%s'", minVersion)
+	}
+	def := "none"
+	if tr.caFile != "" {
+		def = "require"
+	}
+	clientAuth, err := cfg.Get("tls.client-auth", def)
+	if err != nil {
+		return nil, err
+	}
+	tr.clientAuth, ok = tlsClientAuth[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS client-auth setting '%s'", clientAuth)
+	}
+	if tr.clientAuth != tls.NoClientCert && tr.caFile == "" {
+		return nil, fmt.Errorf("tls.client-ca must be set to verify client certificates")
+	}
+	interval, err := cfg.Get("tls.reload-interval", "1m")
+	if err != nil {
+		return nil, err
+	}
+	tr.interval, err = parsePeriod(interval)
+	if err != nil {
+		return nil, err
+	}
+	err = tr.load()
+	if err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+func (tr *tlsReloader) files() []string {
+	files := []string{tr.certFile, tr.keyFile}
+	if tr.caFile != "" {
+		files = append(files, tr.caFile)
+	}
+	return files
+}
+
+// load reads the certificate files, and creates a new TLS config from them.
+// The current config is only replaced if everything loads successfully.
+func (tr *tlsReloader) load() error {
+	modTime := make(map[string]time.Time)
+	for _, file := range tr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTime[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(tr.certFile, tr.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tr.minVersion,
+		ClientAuth:   tr.clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if tr.caFile != "" {
+		pem, err := ioutil.ReadFile(tr.caFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in '%s'", tr.caFile)
+		}
+	}
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.config = config
+	tr.modTime = modTime
+	return nil
+}
+
+// changed returns true if any of the files have been modified since they were
+// last loaded.
+func (tr *tlsReloader) changed() bool {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+	for _, file := range tr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Probably in the middle of being replaced, try again later.
+			continue
+		}
+		if !info.ModTime().Equal(tr.modTime[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch checks the files for changes at the configured interval, reloading
+// them when they change.  If the reload fails then the old config is kept.  An
+// interval of 0 (i.e. an empty reload-interval) turns reloading off.
+func (tr *tlsReloader) watch() {
+	if tr.interval == 0 {
+		log.Printf("TLS certificate reloading disabled\n")
+		return
+	}
+	for range time.Tick(tr.interval) {
+		if !tr.changed() {
+			continue
+		}
+		err := tr.load()
+		if err != nil {
+			log.Printf("Failed to reload TLS certificates: %s\n", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificates\n")
+	}
+}
+
+func (tr *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+	return tr.config, nil
+}
+
+func (tr *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+	return &tr.config.Certificates[0], nil
+}
+
+// serverConfig returns the TLS config to give to the http.Server.  The real
+// config is picked up for each connection, so that reloads take effect.
+func (tr *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: tr.getConfigForClient,
+		GetCertificate:     tr.getCertificate,
+	}
+}
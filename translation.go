@@ -0,0 +1,99 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// shortDescription returns the first line of a package description.
+func shortDescription(desc string) string {
+	if i := strings.Index(desc, "\n"); i >= 0 {
+		return desc[:i]
+	}
+	return desc
+}
+
+// descriptionMd5 returns the Description-md5 value for the given description,
+// which is calculated the same way as apt does - i.e. the md5 of the complete
+// description including the trailing newline.
+func descriptionMd5(desc string) string {
+	sum := md5.Sum([]byte(desc + "\n"))
+	return hex.EncodeToString(sum[:])
+}
+
+type translation struct {
+	name string
+	md5  string
+	desc string
+}
+
+// writeTranslations writes the i18n/Translation-en files for each component of
+// the given dist, if translations are enabled for the repo.
+func (r *Repo) writeTranslations(codename string) error {
+	if !r.Config.Translations {
+		return nil
+	}
+	d := r.dist(codename)
+	for _, component := range r.Config.Components {
+		dir := filepath.Join(r.distPath(codename), component, "i18n")
+		// The same description will normally be found in several arches, but
+		// only needs to be listed once.
+		seen := make(map[string]bool)
+		var translations []translation
+		for _, arch := range r.Config.Architectures {
+			for name, set := range d.group(component, arch) {
+				for _, pkg := range set {
+					t := translation{name, descriptionMd5(pkg.Description), pkg.Description}
+					if seen[t.name+" "+t.md5] {
+						continue
+					}
+					seen[t.name+" "+t.md5] = true
+					translations = append(translations, t)
+				}
+			}
+		}
+		sort.Slice(translations, func(i, j int) bool {
+			if translations[i].name != translations[j].name {
+				return translations[i].name < translations[j].name
+			}
+			return translations[i].md5 < translations[j].md5
+		})
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			log.Printf("Failed to create directory '%s': %s\n", dir, err)
+			return err
+		}
+		filename := filepath.Join(dir, "Translation-en")
+		w, err := r.newIndexWriter(codename, filename, r.Config.Compressions)
+		if err != nil {
+			return err
+		}
+		for _, t := range translations {
+			s := fmt.Sprintf("Package: %s\n", t.name)
+			s += fmt.Sprintf("Description-md5: %s\n", t.md5)
+			s += fmt.Sprintf("Description-en: %s\n", t.desc)
+			s += "\n"
+			_, err := w.Write([]byte(s))
+			if err != nil {
+				log.Printf("Failed to write '%s': %s\n", filename, err)
+				w.abort()
+				return err
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
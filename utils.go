@@ -10,14 +10,19 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -114,25 +119,99 @@ func randNameGen(nameCh chan string) {
 	}
 }
 
-func saveUpload(prefix, name string, r io.Reader) (string, string, error) {
+// saveUpload writes the uploaded file to a new temporary directory, hashing it
+// as it is written.  It returns the directory, the path of the file and the
+// hashes.
+func saveUpload(prefix, name string, r io.Reader) (string, string, *HashWriter, error) {
 	dir, err := ioutil.TempDir(tmpPath, prefix+"-")
 	if err != nil {
 		log.Printf("Failed to create tmp directory: %s\n", err)
-		return "", "", err
+		return "", "", nil, err
 	}
 	debPath := filepath.Join(dir, name)
 	f, err := os.Create(debPath)
 	if err != nil {
 		log.Printf("Failed to create '%s': %s\n", debPath, err)
-		return dir, "", err
+		return dir, "", nil, err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, r)
+	hw := NewHashWriter(f)
+	_, err = io.Copy(hw, r)
 	if err != nil {
 		log.Printf("Failed to write data to '%s': %s\n", debPath, err)
-		return dir, "", err
+		return dir, "", nil, err
+	}
+	return dir, debPath, hw, nil
+}
+
+// tooLarge returns true if err is caused by a request body being larger than
+// allowed by http.MaxBytesReader.
+func tooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// parseSize parses a size in bytes, which may have a K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	num := s
+	if mult != 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * mult, nil
+}
+
+// saveMultipartUpload saves all the files in a multipart/form-data request into
+// a new temporary directory.  The files are saved using the base name of the
+// filename given in the request.
+func saveMultipartUpload(prefix string, req *http.Request) (string, error) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		log.Printf("Failed to read multipart upload: %s\n", err)
+		return "", err
+	}
+	dir, err := ioutil.TempDir(tmpPath, prefix+"-")
+	if err != nil {
+		log.Printf("Failed to create tmp directory: %s\n", err)
+		return "", err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return dir, nil
+		} else if err != nil {
+			log.Printf("Failed to read multipart upload: %s\n", err)
+			return dir, err
+		}
+		name := filepath.Base(part.FileName())
+		if part.FileName() == "" || name == "." || name == ".." || name == "/" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("Failed to create '%s': %s\n", path, err)
+			return dir, err
+		}
+		_, err = io.Copy(f, part)
+		f.Close()
+		if err != nil {
+			log.Printf("Failed to write data to '%s': %s\n", path, err)
+			return dir, err
+		}
 	}
-	return dir, debPath, nil
 }
 
 func getDefaultKey() (string, error) {
@@ -148,3 +227,108 @@ func getDefaultKey() (string, error) {
 	}
 	return key, nil
 }
+
+// splitList splits a list setting into its items, which are separated by
+// commas or whitespace and may be quoted.  A flow style list (e.g. [a, "b"])
+// is also accepted, as the yaml package returns those as a plain scalar.
+func splitList(s string) []string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	items := []string{}
+	item := ""
+	quoted := false
+	var quote rune
+	for _, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			item += string(c)
+		case c == '"' || c == '\'':
+			quote = c
+			quoted = true
+		case c == ',' || c == ' ' || c == '\t' || c == '\n':
+			if item != "" || quoted {
+				items = append(items, item)
+			}
+			item = ""
+			quoted = false
+		default:
+			item += string(c)
+		}
+	}
+	if item != "" || quoted {
+		items = append(items, item)
+	}
+	return items
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePeriod parses a period setting (e.g. valid-for).  As well as anything
+// accepted by time.ParseDuration, a whole number of days can be given as e.g.
+// "7d".  An empty string means no period, and is returned as 0.
+func parsePeriod(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var days uint64
+		days, err = strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 16)
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period '%s'", s)
+	}
+	return d, nil
+}
+
+// writeFileAtomic writes a file by calling write with a temporary file in the
+// same directory, which is synced and then renamed over path once write has
+// succeeded.  Readers therefore see either the old or the new contents, even
+// if we crash part way through.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Make sure that the rename itself is on disk.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}